@@ -0,0 +1,133 @@
+package main
+
+import "fmt"
+
+// Device is a memory-mapped device connected to the bus.
+type Device interface {
+	// read and write access the device at the offset from its base address.
+	// size is byte, halfword, word or doubleword. false is returned if the device does not support the access.
+	read(offset uint64, size int) (uint64, bool)
+	write(offset, val uint64, size int) bool
+	// tick is called once per cycle.
+	tick()
+	// reset puts the device into the reset state.
+	reset()
+}
+
+type mapping struct {
+	base, size uint64
+	dev        Device
+}
+
+// Bus dispatches physical memory accesses to the devices.
+type Bus struct {
+	mappings []mapping
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// register maps the device to [base, base+size). The region must not overlap with the other devices.
+func (b *Bus) register(base, size uint64, dev Device) error {
+	if size == 0 || base+size-1 < base {
+		return fmt.Errorf("invalid device region: base %#x, size %#x", base, size)
+	}
+
+	for _, m := range b.mappings {
+		if base <= m.base+m.size-1 && m.base <= base+size-1 {
+			return fmt.Errorf("device region [%#x, %#x) overlaps with [%#x, %#x)", base, base+size, m.base, m.base+m.size)
+		}
+	}
+
+	b.mappings = append(b.mappings, mapping{base: base, size: size, dev: dev})
+	return nil
+}
+
+// find returns the device which has the range [addr, addr+length).
+func (b *Bus) find(addr, length uint64) (mapping, bool) {
+	for _, m := range b.mappings {
+		if addr >= m.base && length <= m.size && addr-m.base <= m.size-length {
+			return m, true
+		}
+	}
+
+	return mapping{}, false
+}
+
+// read returns false if no device is mapped at the address or the device rejects the access.
+func (b *Bus) read(addr uint64, size int) (uint64, bool) {
+	m, ok := b.find(addr, uint64(size/8))
+	if !ok {
+		return 0, false
+	}
+
+	return m.dev.read(addr-m.base, size)
+}
+
+// write returns false if no device is mapped at the address or the device rejects the access.
+func (b *Bus) write(addr, val uint64, size int) bool {
+	m, ok := b.find(addr, uint64(size/8))
+	if !ok {
+		return false
+	}
+
+	return m.dev.write(addr-m.base, val, size)
+}
+
+// tick ticks the devices in the order of registration.
+func (b *Bus) tick() {
+	for _, m := range b.mappings {
+		m.dev.tick()
+	}
+}
+
+func (b *Bus) reset() {
+	for _, m := range b.mappings {
+		m.dev.reset()
+	}
+}
+
+// readReg returns the part of the register value accessed at the offset from the register.
+func readReg(reg, offset uint64, size int) uint64 {
+	v := reg >> (offset * 8)
+	if size < doubleword {
+		v &= 1<<size - 1
+	}
+	return v
+}
+
+// writeReg returns the register value updated by the access at the offset from the register.
+func writeReg(reg, offset, val uint64, size int) uint64 {
+	mask := ^uint64(0)
+	if size < doubleword {
+		mask = 1<<size - 1
+	}
+	return reg&^(mask<<(offset*8)) | (val&mask)<<(offset*8)
+}
+
+// Rom is a read-only memory.
+type Rom struct {
+	data []byte
+}
+
+func NewRom(size int) *Rom {
+	return &Rom{data: make([]byte, size)}
+}
+
+func (r *Rom) read(offset uint64, size int) (uint64, bool) {
+	v := uint64(0)
+	for i := uint64(0); i < uint64(size/8); i++ {
+		v |= uint64(r.data[offset+i]) << (i * 8)
+	}
+	return v, true
+}
+
+func (r *Rom) write(offset, val uint64, size int) bool {
+	return false
+}
+
+func (r *Rom) tick() {}
+
+// reset keeps the content, as it is loaded by the host.
+func (r *Rom) reset() {}
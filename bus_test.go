@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	rom := NewRom(0x100)
+	rom.data[0x10] = 0xab
+
+	if err := b.register(0x1000, 0x100, rom); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.register(0x10ff, 0x10, NewRom(0x10)); err == nil {
+		t.Fatalf("overlapping region must be rejected")
+	}
+	if err := b.register(0x1100, 0x10, NewRom(0x10)); err != nil {
+		t.Fatalf("adjacent region must be accepted: %s", err)
+	}
+
+	if got, ok := b.read(0x1010, byt); !ok || got != 0xab {
+		t.Fatalf("read: want 0xab, got %#x (ok: %t)", got, ok)
+	}
+	if _, ok := b.read(0x10fe, word); ok {
+		t.Fatalf("access across the devices must fail")
+	}
+	if _, ok := b.read(0x2000, byt); ok {
+		t.Fatalf("access to the unmapped address must fail")
+	}
+	if b.write(0x1010, 0, byt) {
+		t.Fatalf("write to rom must fail")
+	}
+}
@@ -1,14 +1,80 @@
 package main
 
-type Clint struct{}
+// CLINT (core local interruptor) compatible with SiFive's one.
+// It is located at 0x0200_0000 and provides software and timer interrupts for the hart.
+const (
+	clintBase     = 0x0200_0000
+	clintSize     = 0x10000
+	clintMsip     = 0x0
+	clintMtimecmp = 0x4000
+	clintMtime    = 0xbff8
 
-func NewClint() *Clint {
-	return nil
+	mipMsip = 1 << machineSoftwareIntr
+	mipMtip = 1 << machineTimerIntr
+)
+
+type Clint struct {
+	msip     uint32
+	mtimecmp uint64
+	mtime    uint64
+
+	mip *uint64
+}
+
+func NewClint(mip *uint64) *Clint {
+	return &Clint{
+		msip: 0,
+		// avoid the timer interrupt to be pending until mtimecmp is set
+		mtimecmp: ^uint64(0),
+		mtime:    0,
+		mip:      mip,
+	}
+}
+
+func (c *Clint) reset() {
+	*c = *NewClint(c.mip)
 }
 
-func (c *Clint) read(addr uint64) uint8 {
-	return 0
+// tick increments mtime and reflects the interrupt state on mip.
+func (c *Clint) tick() {
+	c.mtime++
+
+	if c.msip&1 == 1 {
+		*c.mip |= mipMsip
+	} else {
+		*c.mip &^= mipMsip
+	}
+
+	if c.mtime >= c.mtimecmp {
+		*c.mip |= mipMtip
+	} else {
+		*c.mip &^= mipMtip
+	}
+}
+
+func (c *Clint) read(offset uint64, size int) (uint64, bool) {
+	switch {
+	case clintMsip <= offset && offset < clintMsip+4:
+		return readReg(uint64(c.msip), offset-clintMsip, size), true
+	case clintMtimecmp <= offset && offset < clintMtimecmp+8:
+		return readReg(c.mtimecmp, offset-clintMtimecmp, size), true
+	case clintMtime <= offset && offset < clintMtime+8:
+		return readReg(c.mtime, offset-clintMtime, size), true
+	}
+
+	return 0, true
 }
 
-func (c *Clint) write(addr uint64, value uint8) {
+func (c *Clint) write(offset, val uint64, size int) bool {
+	switch {
+	case clintMsip <= offset && offset < clintMsip+4:
+		// only msip[0] is writable
+		c.msip = uint32(writeReg(uint64(c.msip), offset-clintMsip, val, size) & 1)
+	case clintMtimecmp <= offset && offset < clintMtimecmp+8:
+		c.mtimecmp = writeReg(c.mtimecmp, offset-clintMtimecmp, val, size)
+	case clintMtime <= offset && offset < clintMtime+8:
+		c.mtime = writeReg(c.mtime, offset-clintMtime, val, size)
+	}
+
+	return true
 }
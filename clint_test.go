@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestClint(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(cpu *CPU)
+		mie   uint64
+		cause uint64
+	}{
+		{"timer", func(cpu *CPU) { cpu.writeRaw(clintBase+clintMtimecmp, 5, doubleword) }, mipMtip, 1<<63 | machineTimerIntr},
+		{"software", func(cpu *CPU) { cpu.writeRaw(clintBase+clintMsip, 1, word) }, mipMsip, 1<<63 | machineSoftwareIntr},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.ram.Write(drambase, 0x0000006f, word) // j .
+			cpu.pc = drambase
+			cpu.wcsr(mtvec, drambase+0x100)
+			cpu.wcsr(mie, tc.mie)
+			cpu.wcsr(mstatus, 0x8) // MIE
+			tc.setup(cpu)
+
+			for i := 0; i < 10 && cpu.pc == drambase; i++ {
+				if err := cpu.tick(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if cpu.pc != drambase+0x100 {
+				t.Fatalf("interrupt is not taken: pc %#x", cpu.pc)
+			}
+
+			if got := cpu.rcsr(mcause); got != tc.cause {
+				t.Errorf("mcause: want %#x, got %#x", tc.cause, got)
+			}
+
+			if got, _ := cpu.readRaw(clintBase+clintMtime, doubleword); got != cpu.rcsr(timecsr) {
+				t.Errorf("time csr: want %d, got %d", got, cpu.rcsr(timecsr))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// console is the host side of the UART.
+type console struct {
+	in  io.Reader // nil if the console has no input
+	out io.Writer
+	// close releases the host resources.
+	close func() error
+}
+
+// openConsole opens the console described by spec:
+//
+//	stdio        the standard input and output of rv
+//	none         no input, and the output is discarded
+//	file:PATH    the output is written to the file, and there is no input
+//	unix:PATH    the first connection to the Unix socket listening on the path
+//	tcp:PORT     the first connection to the TCP port listening on localhost
+//	pty          a new pseudo terminal, whose name is printed to stderr
+//
+// unix and tcp wait for the connection before returning.
+func openConsole(spec string) (*console, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	noop := func() error { return nil }
+
+	switch kind {
+	case "stdio":
+		return &console{in: os.Stdin, out: os.Stdout, close: noop}, nil
+
+	case "none":
+		return &console{out: io.Discard, close: noop}, nil
+
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("file console needs a path")
+		}
+		f, err := os.Create(arg)
+		if err != nil {
+			return nil, fmt.Errorf("open console file: %w", err)
+		}
+		return &console{out: f, close: f.Close}, nil
+
+	case "unix":
+		if arg == "" {
+			return nil, fmt.Errorf("unix console needs a socket path")
+		}
+		c, err := acceptConsole("unix", arg)
+		if err != nil {
+			return nil, err
+		}
+		return &console{in: c, out: c, close: c.Close}, nil
+
+	case "tcp":
+		if arg == "" {
+			return nil, fmt.Errorf("tcp console needs a port")
+		}
+		c, err := acceptConsole("tcp", net.JoinHostPort("localhost", arg))
+		if err != nil {
+			return nil, err
+		}
+		return &console{in: c, out: c, close: c.Close}, nil
+
+	case "pty":
+		master, slave, err := openPTY()
+		if err != nil {
+			return nil, fmt.Errorf("open pty: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "rv: console is on %s\n", slave.Name())
+		return &console{in: master, out: master, close: func() error {
+			slave.Close()
+			return master.Close()
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("invalid console: %q", spec)
+}
+
+// acceptConsole listens on the address and returns the first connection.
+func acceptConsole(network, addr string) (net.Conn, error) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen console: %w", err)
+	}
+	defer l.Close()
+
+	fmt.Fprintf(os.Stderr, "rv: waiting for the console connection on %s\n", l.Addr())
+	c, err := l.Accept()
+	if err != nil {
+		return nil, fmt.Errorf("accept console: %w", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("pty is supported only on Linux")
+}
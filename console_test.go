@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsole(t *testing.T) {
+	dir := t.TempDir()
+
+	// file
+	path := filepath.Join(dir, "out")
+	c, err := openConsole("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.out.Write([]byte("hello"))
+	c.close()
+	if got, err := os.ReadFile(path); err != nil || string(got) != "hello" {
+		t.Fatalf("file: %q, %v", got, err)
+	}
+
+	// unix socket waits for the connection
+	path = filepath.Join(dir, "sock")
+	go func() {
+		for i := 0; i < 100; i++ {
+			conn, err := net.Dial("unix", path)
+			if err == nil {
+				conn.Write([]byte("x"))
+				conn.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	c, err = openConsole("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if n, err := c.in.Read(buf); n != 1 || buf[0] != 'x' {
+		t.Fatalf("unix: %q, %v", buf[:n], err)
+	}
+	c.close()
+
+	for _, spec := range []string{"", "file:", "tcp:", "serial"} {
+		if _, err := openConsole(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
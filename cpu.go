@@ -40,32 +40,66 @@ const (
 	sideleg     uint64 = 0x103
 	sie         uint64 = 0x104
 	stvec       uint64 = 0x105
+	scounteren  uint64 = 0x106
+	senvcfg     uint64 = 0x10a
+	sscratch    uint64 = 0x140
 	sepc        uint64 = 0x141
 	scause      uint64 = 0x142
 	stval       uint64 = 0x143
 	sip         uint64 = 0x144
 	satp        uint64 = 0x180
 	mstatus     uint64 = 0x300
+	misa        uint64 = 0x301
 	medeleg     uint64 = 0x302
 	mideleg     uint64 = 0x303
 	mie         uint64 = 0x304
 	mtvec       uint64 = 0x305
+	mcounteren  uint64 = 0x306
+	menvcfg     uint64 = 0x30a
+	mscratch    uint64 = 0x340
 	mepc        uint64 = 0x341
 	mcause      uint64 = 0x342
 	mtval       uint64 = 0x343
 	mip         uint64 = 0x344
+	pmpcfg0     uint64 = 0x3a0
+	pmpaddr0    uint64 = 0x3b0
 	cycle       uint64 = 0xc00
+	timecsr     uint64 = 0xc01 // "time" collides with the package name
+	instret     uint64 = 0xc02
+	mvendorid   uint64 = 0xf11
+	marchid     uint64 = 0xf12
+	mimpid      uint64 = 0xf13
+	mhartid     uint64 = 0xf14
+	mconfigptr  uint64 = 0xf15
+
+	// machine counters
+	mcountinhibit uint64 = 0x320
+	mhpmevent3    uint64 = 0x323
+	mcycle        uint64 = 0xb00
+	minstret      uint64 = 0xb02
+	mhpmcounter3  uint64 = 0xb03
 
 	// memory access type used in address translation
 	maInst  = 1
 	maLoad  = 2
 	maStore = 3
 
-	// addressing mode. sv57 isn't supported in rv
+	// addressing mode
 	svnone = 0
 	sv32   = 1
 	sv39   = 2
 	sv48   = 3
+	sv57   = 4
+
+	// page table entry
+	pteV = 1 << 0
+	pteR = 1 << 1
+	pteW = 1 << 2
+	pteX = 1 << 3
+	pteU = 1 << 4
+	pteG = 1 << 5
+	pteA = 1 << 6
+	pteD = 1 << 7
 
 	// trap
 
@@ -98,6 +132,7 @@ const (
 
 	// memory management
 	drambase = 0x8000_0000
+	dtbbase  = 0x1020
 	dtbsize  = 0xfe0
 )
 
@@ -111,45 +146,101 @@ type CPU struct {
 	xlen           int
 	mode           int
 	wfi            bool
+	haltOnIllegal  bool // stop the emulation on illegal instruction instead of trapping
+	trapMisaligned bool // raise address-misaligned exceptions instead of emulating misaligned accesses
 	pc             uint64
 	addressingMode int
 	ppn            uint64
+	asid           uint64
+	tlb            tlb
+	pmp            []pmpEntry // active PMP entries in the priority order
 
 	csr   [4096]uint64
 	xregs [32]uint64
-	fregs [32]float64
+	fregs [32]uint64 // raw bits, single-precision values are NaN-boxed
 	lrsc  map[uint64]struct{}
 
-	dtb   [dtbsize]uint8
-	clint *Clint
-	disk  *VirtIODisk
-	plic  *Plic
-	ram   *Memory
-	uart  *Uart
+	bus      *Bus
+	dtb      *Rom
+	clint    *Clint
+	disk     *VirtIODisk
+	finisher *Finisher
+	plic     *Plic
+	ram      *Memory
+	uart     *Uart
 }
 
-func NewCPU() *CPU {
-	return &CPU{
-		clock:          0,
-		xlen:           xlen64,
-		mode:           machine,
-		pc:             0,
-		addressingMode: svnone,
-		ppn:            0,
-
-		csr:   [4096]uint64{},
-		xregs: [32]uint64{},
-		fregs: [32]float64{},
-		lrsc:  make(map[uint64]struct{}),
-
-		// TODO: initialize device tree
-		dtb:   [dtbsize]uint8{},
-		clint: NewClint(),
-		disk:  NewVirtIODisk(),
-		plic:  NewPlic(),
-		uart:  NewUart(),
-		ram:   NewMemory(),
+func NewCPU(ramSize uint64) *CPU {
+	cpu := &CPU{
+		xlen: xlen64,
+
+		bus:      NewBus(),
+		dtb:      NewRom(dtbsize),
+		ram:      NewMemory(ramSize),
+		finisher: NewFinisher(),
+	}
+
+	cpu.clint = NewClint(&cpu.csr[mip])
+	cpu.plic = NewPlic(&cpu.csr[mip])
+	// the console is not connected until the caller attaches it.
+	cpu.uart = NewUart(nil, nil, func(level bool) { cpu.plic.setIrq(uartIrq, level) })
+	cpu.disk = NewVirtIODisk(cpu.ram, func(level bool) { cpu.plic.setIrq(virtioIrq, level) })
+
+	// devices are looked up and ticked in this order, so the RAM comes first as it is accessed the most
+	// and the PLIC comes after the interrupt sources.
+	for _, m := range []mapping{
+		{drambase, ramSize, cpu.ram},
+		{dtbbase, dtbsize, cpu.dtb},
+		{finisherBase, finisherSize, cpu.finisher},
+		{clintBase, clintSize, cpu.clint},
+		{uartBase, uartSize, cpu.uart},
+		{virtioBase, virtioSize, cpu.disk},
+		{plicBase, plicSize, cpu.plic},
+	} {
+		if err := cpu.bus.register(m.base, m.size, m.dev); err != nil {
+			panic(err) // the builtin devices never overlap
+		}
+	}
+
+	cpu.reset()
+	return cpu
+}
+
+// reset puts the hart and the devices into the reset state. The memory keeps its content.
+func (cpu *CPU) reset() {
+	cpu.clock = 0
+	cpu.mode = machine
+	cpu.wfi = false
+	cpu.pc = 0
+	cpu.addressingMode = svnone
+	cpu.ppn = 0
+	cpu.asid = 0
+	cpu.tlb.flushAll()
+	cpu.pmp = cpu.pmp[:0]
+
+	cpu.csr = [4096]uint64{}
+	cpu.csr[misa] = misaval
+	cpu.csr[mstatus] = mstatusxl
+	cpu.csr[menvcfg] = menvcfgADUE
+
+	cpu.xregs = [32]uint64{}
+	cpu.fregs = [32]uint64{}
+	cpu.lrsc = make(map[uint64]struct{})
+
+	cpu.bus.reset()
+}
+
+// loadDTB places the device tree blob in memory and passes its address in a1 per the boot convention.
+// a0 holds the hart ID, which is always 0.
+func (cpu *CPU) loadDTB(dtb []byte) error {
+	if len(dtb) > dtbsize {
+		return fmt.Errorf("device tree is too large: %d bytes, must be up to %d bytes", len(dtb), dtbsize)
 	}
+
+	copy(cpu.dtb.data, dtb)
+	cpu.wxreg(10, 0)
+	cpu.wxreg(11, dtbbase)
+	return nil
 }
 
 /*
@@ -166,89 +257,144 @@ func (cpu *CPU) wxreg(i uint64, val uint64) {
 	}
 }
 
-func (cpu *CPU) rfreg(i uint64) float64 {
+func (cpu *CPU) rfreg(i uint64) uint64 {
 	return cpu.fregs[i]
 }
 
-func (cpu *CPU) wfreg(i uint64, val float64) {
-	// f0 is always zero, the write should be discarded in that case
-	if i != 0 {
-		cpu.fregs[i] = val
+func (cpu *CPU) wfreg(i uint64, val uint64) {
+	cpu.fregs[i] = val
+	cpu.dirtyFS()
+}
+
+// rfreg32 reads a single-precision value from the NaN-boxed register.
+// If the upper 32 bits are not all 1, the value is treated as the canonical NaN.
+func (cpu *CPU) rfreg32(i uint64) uint64 {
+	v := cpu.fregs[i]
+	if v>>32 != 0xffffffff {
+		return single.qnan()
 	}
+
+	return v & 0xffffffff
+}
+
+// wfreg32 writes a single-precision value with NaN-boxing.
+func (cpu *CPU) wfreg32(i uint64, val uint64) {
+	cpu.wfreg(i, 0xffffffff_00000000|(val&0xffffffff))
 }
 
 /*
  * csr
  */
 func (cpu *CPU) rcsr(addr uint64) uint64 {
-	if addr == fflags {
-		// fcsr consists of frm (3-bit) + fflags (5-bit)
-		return cpu.csr[fcsr] & 0x1f
-	}
-
-	if addr == frm {
-		// fcsr consists of frm (3-bit) + fflags (5-bit)
-		return (cpu.csr[fcsr] >> 5) & 0x7
-	}
+	return cpu.readCSR(addr, true)
+}
 
-	if addr == sstatus {
-		return cpu.csr[mstatus] & 0x80000003000de162
+// readCSR reads the CSR. The bits driven by devices are included only if driven is true,
+// as read-modify-write instructions write back the bits written by software only.
+func (cpu *CPU) readCSR(addr uint64, driven bool) uint64 {
+	d, ok := csrs[addr]
+	if !ok {
+		return cpu.csr[addr]
 	}
 
-	if addr == sip {
-		return cpu.csr[mip] & 0x222 // sip is a subset of mip
+	reg := addr
+	if d.alias != 0 {
+		reg = d.alias
 	}
 
-	if addr == sie {
-		return cpu.csr[mie] & 0x222 // sie is a subset of mie
+	v := cpu.csr[reg]
+	if f := csrs[reg].driven; f != nil && driven {
+		v |= f(cpu)
 	}
-
-	return cpu.csr[addr]
+	return (v & d.rmask) >> d.shift
 }
 
+// wcsr writes the value to the CSR. Read-only bits are preserved and WARL fields are legalized.
 func (cpu *CPU) wcsr(addr uint64, value uint64) {
-	if addr == fflags {
-		// fcsr consists of frm (3-bit) + fflags (5-bit)
-		cpu.csr[fcsr] &= ^uint64(0x1f) // clear fcsr[4:0]
-		cpu.csr[fcsr] |= value & 0x1f  // write the value[4:0] to the fcsr[4:0]
+	d, ok := csrs[addr]
+	if !ok {
+		cpu.csr[addr] = value
+		return
 	}
 
-	if addr == frm {
-		// fcsr consists of frm (3-bit) + fflags (5-bit)
-		cpu.csr[fcsr] &= ^uint64(0xe0)       // clear fcsr[7:5]
-		cpu.csr[fcsr] |= (value << 5) & 0xe0 // write the value[2:0] to the fcsr[7:5]
+	reg := addr
+	if d.alias != 0 {
+		reg = d.alias
 	}
 
-	if addr == sstatus {
-		// sstatus is a subset of mstatus
-		cpu.csr[mstatus] &= ^uint64(0x80000003000de162) // clear mask
-		cpu.csr[mstatus] |= value & 0x80000003000de162  // write only mask
+	wmask := d.wmask
+	if l := csrs[reg].locked; l != nil {
+		wmask &^= l(cpu)
 	}
 
-	if addr == sip {
-		cpu.csr[mip] &= ^uint64(0x222)
-		cpu.csr[mip] |= value & 0x222
+	old := cpu.csr[reg]
+	v := old&^wmask | (value<<d.shift)&wmask
+	if l := csrs[reg].legalize; l != nil {
+		v = l(old, v)
 	}
+	cpu.csr[reg] = v
 
-	if addr == sie {
-		cpu.csr[mie] &= ^uint64(0x222)
-		cpu.csr[mie] |= value & 0x222
+	if u := csrs[reg].update; u != nil {
+		u(cpu)
 	}
+}
+
+// checkCSR returns illegal instruction if the CSR access is not permitted.
+// write must be true only if the instruction actually writes to the CSR.
+func (cpu *CPU) checkCSR(addr uint64, write bool, raw uint64) *trap {
+	illegal := &trap{code: illegalInst, value: raw}
 
-	if addr == mideleg {
-		cpu.csr[addr] = value & 0x666
+	if _, ok := csrs[addr]; !ok {
+		return illegal
 	}
 
-	if addr != 0 {
-		cpu.csr[addr] = value
+	// csr[11:10] = 0b11 means the CSR is read-only.
+	if write && bits(addr, 11, 10) == 0b11 {
+		return illegal
 	}
 
-	if addr == satp {
-		cpu.updateAddressingMode(value)
+	// csr[9:8] encodes the lowest privilege level that can access the CSR.
+	if uint64(cpu.mode) < bits(addr, 9, 8) {
+		return illegal
 	}
+
+	switch {
+	case addr == fflags || addr == frm || addr == fcsr:
+		if cpu.fsOff() {
+			return illegal
+		}
+
+	case addr == satp:
+		// mstatus.TVM traps satp access in S-mode.
+		if cpu.mode == supervisor && bit(cpu.csr[mstatus], 20) == 1 {
+			return illegal
+		}
+
+	case addr >= cycle && addr <= 0xc1f:
+		// counters are visible to lower privilege levels only if
+		// the corresponding bit in mcounteren (and scounteren for U-mode) is set.
+		i := int(addr - cycle)
+		if cpu.mode < machine && bit(cpu.csr[mcounteren], i) == 0 {
+			return illegal
+		}
+		if cpu.mode < supervisor && bit(cpu.csr[scounteren], i) == 0 {
+			return illegal
+		}
+	}
+
+	return nil
 }
 
 func (cpu *CPU) updateAddressingMode(value uint64) {
+	oldMode := cpu.addressingMode
+	// the TLB survives the change of the ASID and the root page table as sfence.vma is required then,
+	// but the entries are no longer valid if the format of the page table changes.
+	defer func() {
+		if cpu.addressingMode != oldMode {
+			cpu.tlb.flushAll()
+		}
+	}()
+
 	switch cpu.xlen {
 	case xlen32:
 		if value&0x80000000 == 0 {
@@ -258,6 +404,7 @@ func (cpu *CPU) updateAddressingMode(value uint64) {
 		}
 
 		cpu.ppn = value & 0x3fffff
+		cpu.asid = (value >> 22) & 0x1ff
 	case xlen64:
 		switch value >> 60 {
 		case 0:
@@ -266,11 +413,49 @@ func (cpu *CPU) updateAddressingMode(value uint64) {
 			cpu.addressingMode = sv39
 		case 9:
 			cpu.addressingMode = sv48
-		default:
-			panic("unknown addressing mode")
+		case 10:
+			cpu.addressingMode = sv57
 		}
 
 		cpu.ppn = value & 0xfffffffffff
+		cpu.asid = (value >> 44) & 0xffff
+	}
+}
+
+/*
+ * floating-point
+ */
+
+// roundingMode returns the rounding mode specified in the rm field of the instruction.
+// Reserved rounding modes raise illegal instruction.
+func (cpu *CPU) roundingMode(raw uint64) (uint64, *trap) {
+	rm := bits(raw, 14, 12)
+	if rm == dyn {
+		rm = cpu.rcsr(frm)
+	}
+
+	if rm > rmm {
+		return 0, &trap{code: illegalInst, value: raw}
+	}
+
+	return rm, nil
+}
+
+// fsOff returns true if mstatus.FS is Off, which makes floating-point instructions illegal.
+func (cpu *CPU) fsOff() bool {
+	return bits(cpu.csr[mstatus], 14, 13) == 0
+}
+
+// dirtyFS sets mstatus.FS to Dirty to tell the OS the floating-point state must be saved
+// on context switch.
+func (cpu *CPU) dirtyFS() {
+	cpu.csr[mstatus] |= 0x6000 | 1<<63 // FS and SD
+}
+
+// setFflags accrues the exception flags into fflags.
+func (cpu *CPU) setFflags(fl uint64) {
+	if fl != 0 {
+		cpu.wcsr(fflags, cpu.rcsr(fflags)|fl)
 	}
 }
 
@@ -304,246 +489,294 @@ func (cpu *CPU) getEffectiveAddr(addr uint64) uint64 {
 
 func (cpu *CPU) fetch() (uint64, *trap) {
 	vAddr := cpu.pc
+	// jumps and branches never make pc odd as IALIGN is 16, but check it just in case.
+	if vAddr&1 != 0 {
+		return 0, &trap{code: instAddrMisalighed, value: vAddr}
+	}
+
 	if (vAddr & 0xfff) <= 0x1000-4 {
 		eAddr := cpu.getEffectiveAddr(vAddr)
 		pa, excp := cpu.translate(eAddr, maInst)
 		if excp != nil {
-			return 0, &trap{code: instPageFault, value: vAddr}
+			return 0, &trap{code: excp.code, value: vAddr}
+		}
+
+		// PMP is checked for each half as the instruction might be compressed.
+		if !cpu.pmpCheck(pa, 2, maInst, cpu.mode) {
+			return 0, &trap{code: instAccessFault, value: vAddr}
+		}
+
+		v, ok := cpu.readRaw(pa, word)
+		if !ok {
+			return 0, &trap{code: instAccessFault, value: vAddr}
 		}
 
-		v := cpu.readRaw(pa, word)
+		if v&0x3 == 0x3 && !cpu.pmpCheck(pa+2, 2, maInst, cpu.mode) {
+			return 0, &trap{code: instAccessFault, value: vAddr + 2}
+		}
 
 		return v, nil
 	}
 
-	data := uint64(0)
-	for i := uint64(0); i < 4; i++ {
-		eAddr := cpu.getEffectiveAddr(vAddr + 1)
-		pa, excp := cpu.translate(eAddr, maInst)
-		if excp != nil {
-			return 0, &trap{code: instPageFault, value: vAddr}
-		}
+	// The instruction might cross the page boundary.
+	// Read the lower 16 bits first not to fault on the next page for a compressed instruction.
+	eAddr := cpu.getEffectiveAddr(vAddr)
+	pa, excp := cpu.translate(eAddr, maInst)
+	if excp != nil {
+		return 0, &trap{code: excp.code, value: vAddr}
+	}
 
-		v := cpu.ram.Read(pa, byt)
-		data |= v << (i * 8)
+	if !cpu.pmpCheck(pa, 2, maInst, cpu.mode) {
+		return 0, &trap{code: instAccessFault, value: vAddr}
 	}
 
-	return data, nil
+	lo, ok := cpu.readRaw(pa, halfword)
+	if !ok {
+		return 0, &trap{code: instAccessFault, value: vAddr}
+	}
+	if lo&0x3 != 0x3 {
+		return lo, nil
+	}
+
+	eAddr = cpu.getEffectiveAddr(vAddr + 2)
+	pa, excp = cpu.translate(eAddr, maInst)
+	if excp != nil {
+		return 0, &trap{code: excp.code, value: vAddr + 2}
+	}
+
+	if !cpu.pmpCheck(pa, 2, maInst, cpu.mode) {
+		return 0, &trap{code: instAccessFault, value: vAddr + 2}
+	}
+
+	hi, ok := cpu.readRaw(pa, halfword)
+	if !ok {
+		return 0, &trap{code: instAccessFault, value: vAddr + 2}
+	}
+
+	return hi<<16 | lo, nil
 }
 
-func (cpu *CPU) read(vaddr uint64, size int) (uint64, *trap) {
-	//if (vaddr & 0xfff) <= 0x1000-uint64(size/8) {
-	//	paddr, excp := cpu.translate(vaddr, maLoad)
-	//	if excp != nil {
-	//		return 0, &trap{code: loadPageFault, value: vaddr}
-	//	}
+// misaligned returns true if the access is not naturally aligned.
+func misaligned(addr uint64, size int) bool {
+	return addr&uint64(size/8-1) != 0
+}
 
-	//	return cpu.readRaw(paddr, size), nil
-	//}
+// translateAccess translates the access which might cross the page boundary, and checks it against PMP.
+// n is the length of the first part on the page of vaddr, and the rest is located at paddr2.
+// Both pages are translated before the access so that a misaligned access never partially succeeds.
+func (cpu *CPU) translateAccess(vaddr uint64, size int, ma int) (paddr1, paddr2, n uint64, excp *trap) {
+	length := uint64(size / 8)
+	n = 0x1000 - (vaddr & 0xfff)
+	if n > length {
+		n = length
+	}
 
-	data := uint64(0)
-	for i := 0; i < size/8; i++ {
-		eaddr := cpu.getEffectiveAddr(vaddr + uint64(i))
-		paddr, excp := cpu.translate(eaddr, maLoad)
-		if excp != nil {
-			return 0, &trap{code: loadPageFault, value: vaddr}
-		}
+	mode := cpu.dataMode()
 
-		v := cpu.readRaw(paddr, byt)
-		data |= v << (i * 8)
+	paddr1, excp = cpu.translate(cpu.getEffectiveAddr(vaddr), ma)
+	if excp != nil {
+		return 0, 0, 0, &trap{code: excp.code, value: vaddr}
 	}
 
-	return data, nil
+	if !cpu.pmpCheck(paddr1, n, ma, mode) {
+		return 0, 0, 0, accessFault(ma, vaddr)
+	}
+
+	if n == length {
+		return paddr1, 0, n, nil
+	}
+
+	paddr2, excp = cpu.translate(cpu.getEffectiveAddr(vaddr+n), ma)
+	if excp != nil {
+		return 0, 0, 0, &trap{code: excp.code, value: vaddr + n}
+	}
+
+	if !cpu.pmpCheck(paddr2, length-n, ma, mode) {
+		return 0, 0, 0, accessFault(ma, vaddr+n)
+	}
+
+	return paddr1, paddr2, n, nil
 }
 
-func (cpu *CPU) readRaw(paddr uint64, size int) uint64 {
-	eaddr := cpu.getEffectiveAddr(paddr)
+func (cpu *CPU) read(vaddr uint64, size int) (uint64, *trap) {
+	if cpu.trapMisaligned && misaligned(vaddr, size) {
+		return 0, &trap{code: loadAddrMisaligned, value: vaddr}
+	}
+
+	paddr1, paddr2, n, excp := cpu.translateAccess(vaddr, size, maLoad)
+	if excp != nil {
+		return 0, excp
+	}
 
-	// overflow := false
-	// if size > byt {
-	// 	overflow = eaddr+uint64(size/8-1) > eaddr
-	// }
+	// the access is done at once if it does not cross the page boundary,
+	// so that the device sees the access size.
+	if n == uint64(size/8) {
+		v, ok := cpu.readRaw(paddr1, size)
+		if !ok {
+			return 0, &trap{code: loadAccessFault, value: vaddr}
+		}
 
-	// if eaddr >= drambase && !overflow {
-	if eaddr >= drambase {
-		return cpu.ram.Read(eaddr, size)
+		return v, nil
 	}
 
 	data := uint64(0)
-	for i := 0; i < size/8; i++ {
-		a := eaddr + uint64(i)
-		var d uint8 = 0
-		switch {
-		case 0x00001020 <= a && a < 0x00001fff:
-			d = cpu.dtb[a-0x1020]
-		case 0x02000000 <= a && a < 0x0200ffff:
-			d = cpu.clint.read(a)
-		case 0x0c000000 <= a && a < 0x0fffffff:
-			d = cpu.plic.read(a)
-		case 0x10000000 <= a && a < 0x100000ff:
-			d = cpu.uart.read(a)
-		case 0x10001000 <= a && a < 0x10001fff:
-			d = cpu.disk.read(a)
-		default:
-			panic(fmt.Sprintf("unknown mem seg: %b", a))
+	for i := uint64(0); i < uint64(size/8); i++ {
+		paddr := paddr1 + i
+		if i >= n {
+			paddr = paddr2 + i - n
+		}
+
+		v, ok := cpu.readRaw(paddr, byt)
+		if !ok {
+			return 0, &trap{code: loadAccessFault, value: vaddr + i}
 		}
-		data |= uint64(d << (uint8(i) * 8))
+		data |= v << (i * 8)
 	}
 
-	return data
+	return data, nil
 }
 
-func (cpu *CPU) write(vaddr, val uint64, size int) *trap {
-	// Cancel reserved memory to make SC fail when an write is called
-	// between LR and SC.
-	//if cpu.reserved(addr) {
-	//	cpu.cancel(addr)
-	//}
+// readAMO reads the memory for an AMO, which raises store/AMO faults instead of load faults.
+// A misaligned AMO always traps regardless of the policy.
+func (cpu *CPU) readAMO(vaddr uint64, size int) (uint64, *trap) {
+	if misaligned(vaddr, size) {
+		return 0, &trap{code: storeAddrMisaligned, value: vaddr}
+	}
 
-	//if (addr & 0xfff) <= 0x1000-uint64(size/8) {
-	//	eAddr := cpu.getEffectiveAddr(addr)
-	//	pAddr, excp := cpu.translate(eAddr, maStore)
-	//	if excp != nil {
-	//		return &trap{code: storePageFault, value: addr}
-	//	}
+	if _, excp := cpu.translate(cpu.getEffectiveAddr(vaddr), maStore); excp != nil {
+		return 0, &trap{code: excp.code, value: vaddr}
+	}
 
-	//	cpu.ram.Write(pAddr, val, size)
-	//}
+	v, excp := cpu.read(vaddr, size)
+	if excp != nil && excp.code == loadAccessFault {
+		excp.code = storeAccessFault
+	}
 
-	for i := 0; i < size/8; i++ {
-		a := vaddr + uint64(i)
-		v := (val >> (i * 8)) & 0xff
-		paddr, excp := cpu.translate(a, maStore)
-		if excp != nil {
-			return &trap{code: storePageFault, value: a}
-		}
+	return v, excp
+}
+
+// readRaw reads the physical memory. ok is false if nothing is mapped at the address.
+func (cpu *CPU) readRaw(paddr uint64, size int) (data uint64, ok bool) {
+	return cpu.bus.read(cpu.getEffectiveAddr(paddr), size)
+}
 
-		cpu.writeRaw(paddr, v, byt)
+func (cpu *CPU) write(vaddr, val uint64, size int) *trap {
+	if cpu.trapMisaligned && misaligned(vaddr, size) {
+		return &trap{code: storeAddrMisaligned, value: vaddr}
 	}
 
-	return nil
-}
+	paddr1, paddr2, n, excp := cpu.translateAccess(vaddr, size, maStore)
+	if excp != nil {
+		return excp
+	}
 
-func (cpu *CPU) writeRaw(addr, val uint64, size int) {
-	ea := cpu.getEffectiveAddr(addr)
+	// the access is done at once if it does not cross the page boundary,
+	// so that the device sees the access size.
+	if n == uint64(size/8) {
+		if !cpu.writeRaw(paddr1, val, size) {
+			return &trap{code: storeAccessFault, value: vaddr}
+		}
 
-	// overflow := false
-	// if size > byt {
-	// 	overflow = ea+uint64(size/8-1) > ea
-	// }
+		return nil
+	}
 
-	// if ea >= drambase && !overflow {
-	if ea >= drambase {
-		cpu.ram.Write(ea, val, size)
-		return
+	// make sure both parts are mapped before writing anything.
+	if _, ok := cpu.bus.find(cpu.getEffectiveAddr(paddr1), n); !ok {
+		return &trap{code: storeAccessFault, value: vaddr}
+	}
+	if _, ok := cpu.bus.find(cpu.getEffectiveAddr(paddr2), uint64(size/8)-n); !ok {
+		return &trap{code: storeAccessFault, value: vaddr + n}
 	}
 
-	for i := 0; i < size/8; i++ {
-		v := uint8((val >> (i * 8)) & 0xff)
-		a := ea + uint64(i)
-		switch {
-		case 0x02000000 <= a && a < 0x0200ffff:
-			cpu.clint.write(a, v)
-		case 0x0c000000 <= a && a < 0x0fffffff:
-			cpu.plic.write(a, v)
-		case 0x10000000 <= a && a < 0x10000fff:
-			cpu.uart.write(a, v)
-		case 0x10001000 <= a && a < 0x10001fff:
-			cpu.disk.write(a, v)
-		default:
-			panic("unknown mem seg")
+	for i := uint64(0); i < uint64(size/8); i++ {
+		paddr := paddr1 + i
+		if i >= n {
+			paddr = paddr2 + i - n
+		}
+
+		if !cpu.writeRaw(paddr, (val>>(i*8))&0xff, byt) {
+			return &trap{code: storeAccessFault, value: vaddr + i}
 		}
 	}
+
+	return nil
+}
+
+// writeRaw writes to the physical memory. It returns false if nothing is mapped at the address.
+func (cpu *CPU) writeRaw(addr, val uint64, size int) bool {
+	return cpu.bus.write(cpu.getEffectiveAddr(addr), val, size)
 }
 
 func (cpu *CPU) translate(vAddr uint64, ma int) (uint64, *trap) {
 	eAddr := cpu.getEffectiveAddr(vAddr)
 
-	switch cpu.addressingMode {
-	case svnone:
+	if cpu.addressingMode == svnone {
 		return eAddr, nil
+	}
 
-	case sv32:
-		switch cpu.mode {
-		case machine:
-			switch ma {
-			case maInst:
-				return eAddr, nil
-			default:
-				mst := cpu.rcsr(mstatus)
-				if (mst>>17)&1 == 0 {
-					return eAddr, nil
-				}
-
-				newMode := (mst >> 9) & 3
-				if newMode == machine {
-					return eAddr, nil
-				}
-
-				curMode := cpu.mode
-				cpu.mode = int(newMode)
-				r, excp := cpu.translate(vAddr, ma)
-				if excp != nil {
-					return 0, excp
-				}
-				cpu.mode = curMode
-				return r, nil
+	if cpu.mode == machine {
+		if ma == maInst {
+			return eAddr, nil
+		}
 
-			}
-		case supervisor, user:
-			vpns := []uint64{(eAddr >> 12) & 0x1ff, (eAddr >> 22) & 0x3ff}
-			return cpu.traversePage(eAddr, 2-1, cpu.ppn, vpns, ma)
+		// mstatus.MPRV translates loads and stores as though the privilege mode is MPP.
+		mst := cpu.rcsr(mstatus)
+		if (mst>>17)&1 == 0 {
+			return eAddr, nil
 		}
-	case sv39:
-		switch cpu.mode {
-		case machine:
-			switch ma {
-			case maInst:
-				return eAddr, nil
-			default:
-				mst := cpu.rcsr(mstatus)
-				if (mst>>17)&1 == 0 {
-					return eAddr, nil
-				}
 
-				newMode := (mst >> 9) & 3
-				if newMode == machine {
-					return eAddr, nil
-				}
+		newMode := int((mst >> 11) & 3)
+		if newMode == machine {
+			return eAddr, nil
+		}
 
-				curMode := cpu.mode
-				cpu.mode = int(newMode)
-				r, excp := cpu.translate(vAddr, ma)
-				if excp != nil {
-					return 0, excp
-				}
-				cpu.mode = curMode
-				return r, nil
+		curMode := cpu.mode
+		cpu.mode = newMode
+		r, excp := cpu.translate(vAddr, ma)
+		cpu.mode = curMode
+		return r, excp
+	}
 
-			}
-		case supervisor, user:
-			vpns := []uint64{(eAddr >> 12) & 0x1ff, (eAddr >> 21) & 0x1ff, (eAddr >> 30) & 0x1ff}
-			return cpu.traversePage(eAddr, 3-1, cpu.ppn, vpns, ma)
+	// a store to the page whose D bit is clear walks the page table to set it.
+	if e := cpu.tlb.lookup(eAddr>>12, cpu.asid); e != nil && (ma != maStore || e.pte&pteD != 0) {
+		if !cpu.permitted(e.pte, ma) {
+			return 0, pageFault(ma, vAddr)
 		}
+
+		return e.ppn<<12 | eAddr&0xfff, nil
+	}
+
+	var levels int
+	switch cpu.addressingMode {
+	case sv32:
+		vpns := []uint64{(eAddr >> 12) & 0x3ff, (eAddr >> 22) & 0x3ff}
+		return cpu.traversePage(eAddr, 2-1, cpu.ppn, vpns, ma, 0)
+	case sv39:
+		levels = 3
 	case sv48:
-		panic("sv48 is unsupported")
+		levels = 4
+	case sv57:
+		levels = 5
+	}
+
+	// the upper bits of the virtual address must be the sign extension of the most significant bit.
+	shift := 64 - (12 + 9*levels)
+	if uint64(int64(eAddr<<shift)>>shift) != eAddr {
+		return 0, pageFault(ma, vAddr)
 	}
 
-	panic("unknown addressing mode")
+	vpns := make([]uint64, levels)
+	for i := range vpns {
+		vpns[i] = (eAddr >> (12 + 9*i)) & 0x1ff
+	}
+
+	return cpu.traversePage(eAddr, levels-1, cpu.ppn, vpns, ma, 0)
 }
 
-func (cpu *CPU) traversePage(vAddr uint64, level int, parentPPN uint64, vpns []uint64, ma int) (uint64, *trap) {
+// traversePage walks the page table from the level. global is the G bit inherited from the upper levels.
+func (cpu *CPU) traversePage(vAddr uint64, level int, parentPPN uint64, vpns []uint64, ma int, global uint64) (uint64, *trap) {
 	fault := func() *trap {
-		switch ma {
-		case maInst:
-			return &trap{code: instPageFault, value: vAddr}
-		case maLoad:
-			return &trap{code: loadPageFault, value: vAddr}
-		case maStore:
-			return &trap{code: storePageFault, value: vAddr}
-		}
-
-		return nil // should not come here
+		return pageFault(ma, vAddr)
 	}
 
 	pageSize := uint64(4096)
@@ -552,7 +785,12 @@ func (cpu *CPU) traversePage(vAddr uint64, level int, parentPPN uint64, vpns []u
 		pteSize = uint64(4)
 	}
 
+	// the page table walk is an implicit access in S-mode.
 	pteAddr := parentPPN*pageSize + vpns[level]*pteSize
+	if !cpu.ram.contains(pteAddr, pteSize) || !cpu.pmpCheck(pteAddr, pteSize, maLoad, supervisor) {
+		return 0, accessFault(ma, vAddr)
+	}
+
 	var pte uint64
 	if cpu.addressingMode == sv32 {
 		pte = cpu.ram.Read(pteAddr, word)
@@ -567,15 +805,6 @@ func (cpu *CPU) traversePage(vAddr uint64, level int, parentPPN uint64, vpns []u
 		ppn = (pte >> 10) & 0xfffffffffff
 	}
 
-	var ppns []uint64
-	if cpu.addressingMode == sv32 {
-		ppns = []uint64{(pte >> 10) & 0x3ff, (pte >> 20) & 0xfff, 0}
-	} else {
-		ppns = []uint64{(pte >> 10) & 0x1ff, (pte >> 19) & 0x1ff, (pte >> 28) & 0x3ffffff}
-	}
-
-	d := (pte >> 7) & 1
-	a := (pte >> 6) & 1
 	x := (pte >> 3) & 1
 	w := (pte >> 2) & 1
 	r := (pte >> 1) & 1
@@ -585,78 +814,111 @@ func (cpu *CPU) traversePage(vAddr uint64, level int, parentPPN uint64, vpns []u
 		return 0, fault()
 	}
 
+	// bits 63:54 are reserved as Svnapot and Svpbmt are not supported.
+	if cpu.addressingMode != sv32 && pte>>54 != 0 {
+		return 0, fault()
+	}
+
+	global |= pte & pteG
+
 	if r == 0 && x == 0 {
-		if level == 0 {
+		// D, A and U are reserved for non-leaf PTEs.
+		if level == 0 || pte&(pteD|pteA|pteU) != 0 {
 			return 0, fault()
 		}
 
-		return cpu.traversePage(vAddr, level-1, ppn, vpns, ma)
+		return cpu.traversePage(vAddr, level-1, ppn, vpns, ma, global)
 	}
 
 	// page found
 
-	if a == 0 || (ma == maStore && d == 0) {
-		newPTE := pte | (1 << 6)
+	if !cpu.permitted(pte, ma) {
+		return 0, fault()
+	}
+
+	// a superpage must be aligned to its size, then the lower PPNs come from the virtual address.
+	vpnBits := 9
+	if cpu.addressingMode == sv32 {
+		vpnBits = 10
+	}
+
+	mask := uint64(1)<<(vpnBits*level) - 1
+	if ppn&mask != 0 {
+		return 0, fault()
+	}
+
+	// Svade raises a page fault instead of updating A and D bits unless menvcfg.ADUE is set.
+	if pte&pteA == 0 || (ma == maStore && pte&pteD == 0) {
+		if cpu.csr[menvcfg]&menvcfgADUE == 0 {
+			return 0, fault()
+		}
+
+		if !cpu.pmpCheck(pteAddr, pteSize, maStore, supervisor) {
+			return 0, accessFault(ma, vAddr)
+		}
+
+		pte |= pteA
 		if ma == maStore {
-			newPTE |= (1 << 7)
+			pte |= pteD
 		}
 
 		if cpu.addressingMode == sv32 {
-			cpu.ram.Write(pteAddr, newPTE, word)
+			cpu.ram.Write(pteAddr, pte, word)
 		} else {
-			cpu.ram.Write(pteAddr, newPTE, doubleword)
+			cpu.ram.Write(pteAddr, pte, doubleword)
+		}
+	}
+
+	pa := ((ppn&^mask)|((vAddr>>12)&mask))<<12 | vAddr&0xfff
+	cpu.tlb.insert(tlbEntry{vpn: vAddr >> 12, asid: cpu.asid, ppn: pa >> 12, mask: mask, pte: pte | global})
+	return pa, nil
+}
+
+// permitted returns true if the leaf PTE allows the memory access in the current privilege mode.
+func (cpu *CPU) permitted(pte uint64, ma int) bool {
+	mst := cpu.csr[mstatus]
+
+	if pte&pteU != 0 {
+		// S-mode never executes user pages, and accesses them only if mstatus.SUM is set.
+		if cpu.mode == supervisor && (ma == maInst || bit(mst, 18) == 0) {
+			return false
 		}
+	} else if cpu.mode == user {
+		return false
 	}
 
 	switch ma {
 	case maInst:
-		if x == 0 {
-			return 0, fault()
-		}
+		return pte&pteX != 0
 	case maLoad:
-		if r == 0 {
-			return 0, fault()
-		}
-	case maStore:
-		if w == 0 {
-			return 0, fault()
-		}
+		// mstatus.MXR makes executable pages readable.
+		return pte&pteR != 0 || (bit(mst, 19) == 1 && pte&pteX != 0)
+	default:
+		return pte&pteW != 0
 	}
+}
 
-	offset := vAddr & 0xfff
-	switch cpu.addressingMode {
-	case sv32:
-		switch level {
-		case 1:
-			if ppns[0] != 0 {
-				return 0, fault()
-			}
-
-			return (ppns[1] << 22) | (vpns[0] << 12) | offset, nil
-		case 0:
-			return (ppn << 12) | offset, nil
-		default:
-			panic("invalid level") // should not come here
-		}
+// pageFault returns the page fault exception for the memory access type.
+func pageFault(ma int, vaddr uint64) *trap {
+	switch ma {
+	case maInst:
+		return &trap{code: instPageFault, value: vaddr}
+	case maLoad:
+		return &trap{code: loadPageFault, value: vaddr}
 	default:
-		switch level {
-		case 2:
-			if ppns[1] != 0 || ppns[0] != 0 {
-				return 0, fault()
-			}
-
-			return (ppns[2] << 30) | (vpns[1] << 21) | (vpns[0] << 12) | offset, nil
-		case 1:
-			if ppns[0] != 0 {
-				return 0, fault()
-			}
+		return &trap{code: storePageFault, value: vaddr}
+	}
+}
 
-			return (ppns[2] << 30) | (ppns[1] << 21) | (vpns[0] << 12) | offset, nil
-		case 0:
-			return (ppn << 12) | offset, nil
-		default:
-			panic("invalid level") // should not come here
-		}
+// accessFault returns the access fault exception for the memory access type.
+func accessFault(ma int, vaddr uint64) *trap {
+	switch ma {
+	case maInst:
+		return &trap{code: instAccessFault, value: vaddr}
+	case maLoad:
+		return &trap{code: loadAccessFault, value: vaddr}
+	default:
+		return &trap{code: storeAccessFault, value: vaddr}
 	}
 }
 
@@ -740,33 +1002,277 @@ func (cpu *CPU) decompress(inst uint64) uint64 {
 	case 1:
 		switch funct3 {
 		case 0:
+			// C.ADDI addi rd, rd, nzimm (C.NOP if rd is 0)
+			rd := (inst >> 7) & 0x1f // [11:7]
+			imm := signExtend(
+				((inst>>7)&0x20)| // imm[5] <= [12]
+					((inst>>2)&0x1f), // imm[4:0] <= [6:2]
+				6)
+			return ((imm & 0xfff) << 20) | (rd << 15) | (rd << 7) | 0x13
 		case 1:
+			// C.ADDIW in 64-bit mode addiw rd, rd, imm
+			rd := (inst >> 7) & 0x1f // [11:7]
+			imm := signExtend(
+				((inst>>7)&0x20)| // imm[5] <= [12]
+					((inst>>2)&0x1f), // imm[4:0] <= [6:2]
+				6)
+			if rd != 0 {
+				return ((imm & 0xfff) << 20) | (rd << 15) | (rd << 7) | 0x1b
+			}
+			// rd = 0 is reserved
 		case 2:
+			// C.LI addi rd, x0, imm
+			rd := (inst >> 7) & 0x1f // [11:7]
+			imm := signExtend(
+				((inst>>7)&0x20)| // imm[5] <= [12]
+					((inst>>2)&0x1f), // imm[4:0] <= [6:2]
+				6)
+			return ((imm & 0xfff) << 20) | (rd << 7) | 0x13
 		case 3:
+			rd := (inst >> 7) & 0x1f // [11:7]
+			if rd == 2 {
+				// C.ADDI16SP addi x2, x2, nzimm
+				nzimm :=
+					((inst >> 3) & 0x200) | // nzimm[9] <= [12]
+						((inst >> 2) & 0x10) | // nzimm[4] <= [6]
+						((inst << 1) & 0x40) | // nzimm[6] <= [5]
+						((inst << 4) & 0x180) | // nzimm[8:7] <= [4:3]
+						((inst << 3) & 0x20) // nzimm[5] <= [2]
+				if nzimm != 0 {
+					imm := signExtend(nzimm, 10)
+					return ((imm & 0xfff) << 20) | (2 << 15) | (2 << 7) | 0x13
+				}
+				// nzimm = 0 is reserved
+				break
+			}
+
+			// C.LUI lui rd, nzimm
+			nzimm :=
+				((inst << 5) & 0x20000) | // nzimm[17] <= [12]
+					((inst << 10) & 0x1f000) // nzimm[16:12] <= [6:2]
+			if nzimm != 0 {
+				imm := signExtend(nzimm, 18)
+				return (imm & 0xfffff000) | (rd << 7) | 0x37
+			}
+			// nzimm = 0 is reserved
 		case 4:
+			rd := ((inst >> 7) & 0x7) + 8 // [9:7]
+			switch (inst >> 10) & 0x3 {   // [11:10]
+			case 0:
+				// C.SRLI srli rd+8, rd+8, shamt
+				shamt :=
+					((inst >> 7) & 0x20) | // shamt[5] <= [12]
+						((inst >> 2) & 0x1f) // shamt[4:0] <= [6:2]
+				return (shamt << 20) | (rd << 15) | (5 << 12) | (rd << 7) | 0x13
+			case 1:
+				// C.SRAI srai rd+8, rd+8, shamt
+				shamt :=
+					((inst >> 7) & 0x20) | // shamt[5] <= [12]
+						((inst >> 2) & 0x1f) // shamt[4:0] <= [6:2]
+				return (0x20 << 25) | (shamt << 20) | (rd << 15) | (5 << 12) | (rd << 7) | 0x13
+			case 2:
+				// C.ANDI andi rd+8, rd+8, imm
+				imm := signExtend(
+					((inst>>7)&0x20)| // imm[5] <= [12]
+						((inst>>2)&0x1f), // imm[4:0] <= [6:2]
+					6)
+				return ((imm & 0xfff) << 20) | (rd << 15) | (7 << 12) | (rd << 7) | 0x13
+			case 3:
+				rs2 := ((inst >> 2) & 0x7) + 8 // [4:2]
+				funct2 := (inst >> 5) & 0x3    // [6:5]
+				if (inst>>12)&1 == 0 {
+					switch funct2 {
+					case 0:
+						// C.SUB sub rd+8, rd+8, rs2+8
+						return (0x20 << 25) | (rs2 << 20) | (rd << 15) | (rd << 7) | 0x33
+					case 1:
+						// C.XOR xor rd+8, rd+8, rs2+8
+						return (rs2 << 20) | (rd << 15) | (4 << 12) | (rd << 7) | 0x33
+					case 2:
+						// C.OR or rd+8, rd+8, rs2+8
+						return (rs2 << 20) | (rd << 15) | (6 << 12) | (rd << 7) | 0x33
+					case 3:
+						// C.AND and rd+8, rd+8, rs2+8
+						return (rs2 << 20) | (rd << 15) | (7 << 12) | (rd << 7) | 0x33
+					}
+				} else {
+					switch funct2 {
+					case 0:
+						// C.SUBW subw rd+8, rd+8, rs2+8
+						return (0x20 << 25) | (rs2 << 20) | (rd << 15) | (rd << 7) | 0x3b
+					case 1:
+						// C.ADDW addw rd+8, rd+8, rs2+8
+						return (rs2 << 20) | (rd << 15) | (rd << 7) | 0x3b
+					}
+					// funct2 = 2, 3 are reserved
+				}
+			}
 		case 5:
+			// C.J jal x0, offset
+			offset := signExtend(
+				((inst>>1)&0x800)| // offset[11] <= [12]
+					((inst>>7)&0x10)| // offset[4] <= [11]
+					((inst>>1)&0x300)| // offset[9:8] <= [10:9]
+					((inst<<2)&0x400)| // offset[10] <= [8]
+					((inst>>1)&0x40)| // offset[6] <= [7]
+					((inst<<1)&0x80)| // offset[7] <= [6]
+					((inst>>2)&0xe)| // offset[3:1] <= [5:3]
+					((inst<<3)&0x20), // offset[5] <= [2]
+				12)
+			return encodeJ(offset, 0)
 		case 6:
+			// C.BEQZ beq rs1+8, x0, offset
+			rs1 := ((inst >> 7) & 0x7) + 8 // [9:7]
+			offset := signExtend(
+				((inst>>4)&0x100)| // offset[8] <= [12]
+					((inst>>7)&0x18)| // offset[4:3] <= [11:10]
+					((inst<<1)&0xc0)| // offset[7:6] <= [6:5]
+					((inst>>2)&0x6)| // offset[2:1] <= [4:3]
+					((inst<<3)&0x20), // offset[5] <= [2]
+				9)
+			return encodeB(offset, 0, rs1, 0)
 		case 7:
+			// C.BNEZ bne rs1+8, x0, offset
+			rs1 := ((inst >> 7) & 0x7) + 8 // [9:7]
+			offset := signExtend(
+				((inst>>4)&0x100)| // offset[8] <= [12]
+					((inst>>7)&0x18)| // offset[4:3] <= [11:10]
+					((inst<<1)&0xc0)| // offset[7:6] <= [6:5]
+					((inst>>2)&0x6)| // offset[2:1] <= [4:3]
+					((inst<<3)&0x20), // offset[5] <= [2]
+				9)
+			return encodeB(offset, 0, rs1, 1)
 		}
 	case 2:
+		switch funct3 {
+		case 0:
+			// C.SLLI slli rd, rd, shamt
+			rd := (inst >> 7) & 0x1f // [11:7]
+			shamt :=
+				((inst >> 7) & 0x20) | // shamt[5] <= [12]
+					((inst >> 2) & 0x1f) // shamt[4:0] <= [6:2]
+			return (shamt << 20) | (rd << 15) | (1 << 12) | (rd << 7) | 0x13
+		case 1:
+			// C.FLDSP fld rd, offset(x2)
+			rd := (inst >> 7) & 0x1f // [11:7]
+			offset :=
+				((inst >> 7) & 0x20) | // offset[5] <= [12]
+					((inst >> 2) & 0x18) | // offset[4:3] <= [6:5]
+					((inst << 4) & 0x1c0) // offset[8:6] <= [4:2]
+			return (offset << 20) | (2 << 15) | (3 << 12) | (rd << 7) | 0x7
+		case 2:
+			// C.LWSP lw rd, offset(x2)
+			rd := (inst >> 7) & 0x1f // [11:7]
+			offset :=
+				((inst >> 7) & 0x20) | // offset[5] <= [12]
+					((inst >> 2) & 0x1c) | // offset[4:2] <= [6:4]
+					((inst << 4) & 0xc0) // offset[7:6] <= [3:2]
+			if rd != 0 {
+				return (offset << 20) | (2 << 15) | (2 << 12) | (rd << 7) | 0x3
+			}
+			// rd = 0 is reserved
+		case 3:
+			// C.LDSP in 64-bit mode ld rd, offset(x2)
+			rd := (inst >> 7) & 0x1f // [11:7]
+			offset :=
+				((inst >> 7) & 0x20) | // offset[5] <= [12]
+					((inst >> 2) & 0x18) | // offset[4:3] <= [6:5]
+					((inst << 4) & 0x1c0) // offset[8:6] <= [4:2]
+			if rd != 0 {
+				return (offset << 20) | (2 << 15) | (3 << 12) | (rd << 7) | 0x3
+			}
+			// rd = 0 is reserved
+		case 4:
+			rs1 := (inst >> 7) & 0x1f // [11:7]
+			rs2 := (inst >> 2) & 0x1f // [6:2]
+			if (inst>>12)&1 == 0 {
+				if rs2 == 0 {
+					// C.JR jalr x0, 0(rs1)
+					if rs1 != 0 {
+						return (rs1 << 15) | 0x67
+					}
+					// rs1 = 0 is reserved
+					break
+				}
+
+				// C.MV add rd, x0, rs2
+				return (rs2 << 20) | (rs1 << 7) | 0x33
+			}
+
+			if rs2 == 0 {
+				if rs1 == 0 {
+					// C.EBREAK ebreak
+					return 0x00100073
+				}
+
+				// C.JALR jalr x1, 0(rs1)
+				return (rs1 << 15) | (1 << 7) | 0x67
+			}
+
+			// C.ADD add rd, rd, rs2
+			return (rs2 << 20) | (rs1 << 15) | (rs1 << 7) | 0x33
+		case 5:
+			// C.FSDSP fsd rs2, offset(x2)
+			rs2 := (inst >> 2) & 0x1f // [6:2]
+			offset :=
+				((inst >> 7) & 0x38) | // offset[5:3] <= [12:10]
+					((inst >> 1) & 0x1c0) // offset[8:6] <= [9:7]
+			imm11_5 := (offset >> 5) & 0x7f
+			imm4_0 := offset & 0x1f
+			return (imm11_5 << 25) | (rs2 << 20) | (2 << 15) | (3 << 12) | (imm4_0 << 7) | 0x27
+		case 6:
+			// C.SWSP sw rs2, offset(x2)
+			rs2 := (inst >> 2) & 0x1f // [6:2]
+			offset :=
+				((inst >> 7) & 0x3c) | // offset[5:2] <= [12:9]
+					((inst >> 1) & 0xc0) // offset[7:6] <= [8:7]
+			imm11_5 := (offset >> 5) & 0x7f
+			imm4_0 := offset & 0x1f
+			return (imm11_5 << 25) | (rs2 << 20) | (2 << 15) | (2 << 12) | (imm4_0 << 7) | 0x23
+		case 7:
+			// C.SDSP in 64-bit mode sd rs2, offset(x2)
+			rs2 := (inst >> 2) & 0x1f // [6:2]
+			offset :=
+				((inst >> 7) & 0x38) | // offset[5:3] <= [12:10]
+					((inst >> 1) & 0x1c0) // offset[8:6] <= [9:7]
+			imm11_5 := (offset >> 5) & 0x7f
+			imm4_0 := offset & 0x1f
+			return (imm11_5 << 25) | (rs2 << 20) | (2 << 15) | (3 << 12) | (imm4_0 << 7) | 0x23
+		}
 	}
 
+	// Reserved encodings and the all-zero instruction are illegal.
+	// 0 is returned for them since it is never a valid instruction.
 	return 0x0
 }
 
-func (cpu *CPU) tick() {
+// encodeJ returns jal rd, offset.
+func encodeJ(offset, rd uint64) uint64 {
+	return (bit(offset, 20) << 31) | (bits(offset, 10, 1) << 21) | (bit(offset, 11) << 20) | (bits(offset, 19, 12) << 12) | (rd << 7) | 0x6f
+}
+
+// encodeB returns a branch instruction, whose kind is specified by funct3.
+func encodeB(offset, rs2, rs1, funct3 uint64) uint64 {
+	return (bit(offset, 12) << 31) | (bits(offset, 10, 5) << 25) | (rs2 << 20) | (rs1 << 15) | (funct3 << 12) | (bits(offset, 4, 1) << 8) | (bit(offset, 11) << 7) | 0x63
+}
+
+func (cpu *CPU) tick() error {
 	pc := cpu.pc
 	if excp := cpu.run(); excp != nil {
+		if excp.code == illegalInst && cpu.haltOnIllegal {
+			return fmt.Errorf("illegal instruction %#x at pc %#x", excp.value, pc)
+		}
+
 		cpu.handleExcp(excp, pc)
 	}
 
-	//cpu.clint.tick(cpu.rcsr(mip))
-	//cpu.disk.tick()
-	//cpu.uart.tick()
-	//cpu.plic.tick()
+	cpu.bus.tick()
 	cpu.handleIntr(cpu.pc)
 	cpu.clock++
-	cpu.wcsr(cycle, cpu.clock*8)
+	cpu.csr[cycle] += 8
+	cpu.csr[timecsr] = cpu.clint.mtime
+
+	return nil
 }
 
 func (cpu *CPU) run() *trap {
@@ -777,23 +1283,36 @@ func (cpu *CPU) run() *trap {
 		return nil
 	}
 
-	w, excp := cpu.fetch()
+	inst, excp := cpu.fetch()
 	if excp != nil {
 		return excp
 	}
 
+	w := inst
 	pc := cpu.pc
 	if w&0x3 == 0x3 {
 		cpu.pc += 4
 	} else {
 		cpu.pc += 2 // compressed
-		w = cpu.decompress(w & 0xffff)
+		w = cpu.decompress(inst & 0xffff)
+		if w == 0 {
+			return &trap{code: illegalInst, value: inst & 0xffff}
+		}
+	}
+
+	if excp := cpu.exec(w, pc); excp != nil {
+		return excp
 	}
 
-	return cpu.exec(w, pc)
+	cpu.csr[instret]++
+	return nil
 }
 
 func (cpu *CPU) exec(raw, pc uint64) *trap {
+	if isFPInst(raw) && cpu.fsOff() {
+		return &trap{code: illegalInst, value: raw}
+	}
+
 	switch {
 	case raw&0xfe00707f == 0x00000033: //"add"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
@@ -814,41 +1333,49 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0x0000302f: //"amoadd.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, t+cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, t+cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0x0000202f: //"amoadd.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, t+cpu.rxreg(rs2), word)
+		if excp := cpu.write(addr, t+cpu.rxreg(rs2), word); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, uint64(int64(int32(t))))
 
 	case raw&0xf800707f == 0x6000302f: //"amoand.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, t&cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, t&cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0x6000202f: //"amoand.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, uint64(int64(int32(t)&int32(cpu.rxreg(rs2)))), word)
+		if excp := cpu.write(addr, uint64(int64(int32(t)&int32(cpu.rxreg(rs2)))), word); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, uint64(int64(int32(t))))
 
 		// 11111000000000000111000001111111
@@ -856,16 +1383,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0xa000302f: // amomax.d
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if int64(t) < int64(t2) {
-			cpu.write(addr, uint64(int64(t2)), doubleword)
+			if excp := cpu.write(addr, uint64(int64(t2)), doubleword); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(int64(t)), doubleword)
+			if excp := cpu.write(addr, uint64(int64(t)), doubleword); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(t)))
@@ -873,16 +1404,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0xa000202f: // amomax.w
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if int32(t) < int32(t2) {
-			cpu.write(addr, uint64(int64(int32(t2))), word)
+			if excp := cpu.write(addr, uint64(int64(int32(t2))), word); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(int64(int32(t))), word)
+			if excp := cpu.write(addr, uint64(int64(int32(t))), word); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(int32(t))))
@@ -890,32 +1425,40 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0xe000302f: //"amomaxu.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if t < t2 {
-			cpu.write(addr, t2, doubleword)
+			if excp := cpu.write(addr, t2, doubleword); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, t, doubleword)
+			if excp := cpu.write(addr, t, doubleword); excp != nil {
+				return excp
+			}
 		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0xe000202f: //"amomaxu.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if uint32(t) < uint32(t2) {
-			cpu.write(addr, uint64(uint32(t2)), word)
+			if excp := cpu.write(addr, uint64(uint32(t2)), word); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(uint32(t)), word)
+			if excp := cpu.write(addr, uint64(uint32(t)), word); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(int32(t))))
@@ -923,16 +1466,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0xc000302f: // amominu.d
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if t < t2 {
-			cpu.write(addr, t, doubleword)
+			if excp := cpu.write(addr, t, doubleword); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, t2, doubleword)
+			if excp := cpu.write(addr, t2, doubleword); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, t)
@@ -940,16 +1487,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0xc000202f: // amominu.w
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if uint32(t) < uint32(t2) {
-			cpu.write(addr, uint64(uint32(t)), word)
+			if excp := cpu.write(addr, uint64(uint32(t)), word); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(uint32(t2)), word)
+			if excp := cpu.write(addr, uint64(uint32(t2)), word); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(int32(t))))
@@ -957,16 +1508,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0x8000302f: // amomin.d
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if int64(t) < int64(t2) {
-			cpu.write(addr, uint64(int64(t)), doubleword)
+			if excp := cpu.write(addr, uint64(int64(t)), doubleword); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(int64(t2)), doubleword)
+			if excp := cpu.write(addr, uint64(int64(t2)), doubleword); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(t)))
@@ -974,16 +1529,20 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0x8000202f: // amomin.w
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
 		t2 := cpu.rxreg(rs2)
 
 		if int32(t) < int32(t2) {
-			cpu.write(addr, uint64(int64(int32(t))), word)
+			if excp := cpu.write(addr, uint64(int64(int32(t))), word); excp != nil {
+				return excp
+			}
 		} else {
-			cpu.write(addr, uint64(int64(int32(t2))), word)
+			if excp := cpu.write(addr, uint64(int64(int32(t2))), word); excp != nil {
+				return excp
+			}
 		}
 
 		cpu.wxreg(rd, uint64(int64(int32(t))))
@@ -991,61 +1550,73 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf800707f == 0x4000302f: //"amoor.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, t|cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, t|cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0x4000202f: //"amoor.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, uint64(int64(int32(t)|int32(cpu.rxreg(rs2)))), word)
+		if excp := cpu.write(addr, uint64(int64(int32(t)|int32(cpu.rxreg(rs2)))), word); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, uint64(int64(int32(t))))
 
 	case raw&0xf800707f == 0x0800302f: //"amoswap.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0x0800202f: //"amoswap.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, cpu.rxreg(rs2), word)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), word); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, uint64(int64(int32(t))))
 
 	case raw&0xf800707f == 0x2000302f: // amoxor.d
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, doubleword)
+		t, excp := cpu.readAMO(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, t^cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, t^cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0xf800707f == 0x2000202f: // amoxor.w
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
-		t, excp := cpu.read(addr, word)
+		t, excp := cpu.readAMO(addr, word)
 		if excp != nil {
 			return excp
 		}
-		cpu.write(addr, uint64(int64(int32(t)^int32(cpu.rxreg(rs2)))), word)
+		if excp := cpu.write(addr, uint64(int64(int32(t)^int32(cpu.rxreg(rs2)))), word); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, uint64(int64(int32(t))))
 
 	case raw&0xfe00707f == 0x00007033: //"and"
@@ -1100,38 +1671,65 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00003073: //"csrrc"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		imm = imm & 0b111111111111
+		// rs1 = x0 does not write to the CSR
+		if excp := cpu.checkCSR(imm, rs1 != 0, raw); excp != nil {
+			return excp
+		}
 		t := cpu.rcsr(imm)
-		v := t & ^(cpu.rxreg(rs1))
-		cpu.wcsr(imm, v)
+		if rs1 != 0 {
+			v := cpu.readCSR(imm, false) & ^(cpu.rxreg(rs1))
+			cpu.wcsr(imm, v)
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0x0000707f == 0x00007073: //"csrrci"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		imm = imm & 0b111111111111
+		// zimm = 0 does not write to the CSR
+		if excp := cpu.checkCSR(imm, rs1 != 0, raw); excp != nil {
+			return excp
+		}
 		t := cpu.rcsr(imm)
-		v := t & ^(rs1)
-		cpu.wcsr(imm, v)
+		if rs1 != 0 {
+			v := cpu.readCSR(imm, false) & ^(rs1)
+			cpu.wcsr(imm, v)
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0x0000707f == 0x00002073: //"csrrs"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		imm = imm & 0b111111111111
+		// rs1 = x0 does not write to the CSR
+		if excp := cpu.checkCSR(imm, rs1 != 0, raw); excp != nil {
+			return excp
+		}
 		t := cpu.rcsr(imm)
-		v := t | cpu.rxreg(rs1)
-		cpu.wcsr(imm, v)
+		if rs1 != 0 {
+			v := cpu.readCSR(imm, false) | cpu.rxreg(rs1)
+			cpu.wcsr(imm, v)
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0x0000707f == 0x00006073: //"csrrsi"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		imm = imm & 0b111111111111
+		// zimm = 0 does not write to the CSR
+		if excp := cpu.checkCSR(imm, rs1 != 0, raw); excp != nil {
+			return excp
+		}
 		t := cpu.rcsr(imm)
-		v := t | rs1
-		cpu.wcsr(imm, v) // RS1 is zimm
+		if rs1 != 0 {
+			v := cpu.readCSR(imm, false) | rs1
+			cpu.wcsr(imm, v) // RS1 is zimm
+		}
 		cpu.wxreg(rd, t)
 
 	case raw&0x0000707f == 0x00001073: //"csrrw"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		imm = imm & 0b111111111111
+		if excp := cpu.checkCSR(imm, true, raw); excp != nil {
+			return excp
+		}
 		t := cpu.rcsr(imm)
 		v := cpu.rxreg(rs1)
 		cpu.wcsr(imm, v)
@@ -1140,6 +1738,9 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00005073: //"csrrwi"
 		rd, imm, csr := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		csr = csr & 0b111111111111
+		if excp := cpu.checkCSR(csr, true, raw); excp != nil {
+			return excp
+		}
 		cpu.wxreg(rd, cpu.rcsr(csr))
 		cpu.wcsr(csr, imm)
 
@@ -1148,10 +1749,7 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		dividend := int64(cpu.rxreg(rs1))
 		divisor := int64(cpu.rxreg(rs2))
 		if divisor == 0 {
-			// Division by 0. Set a special flag
-			v := cpu.rcsr(fcsr)
-			v = setBit(v, 3) // DZ (Divided by Zero flag)
-			cpu.wcsr(fcsr, v)
+			// Division by 0.
 			cpu.wxreg(rd, 0xffff_ffff_ffff_ffff)
 		} else if dividend == math.MinInt64 && divisor == -1 {
 			cpu.wxreg(rd, uint64(dividend))
@@ -1164,10 +1762,7 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		dividend := cpu.rxreg(rs1)
 		divisor := cpu.rxreg(rs2)
 		if divisor == 0 {
-			// Division by 0. Set a special flag
-			v := cpu.rcsr(fcsr)
-			v = setBit(v, 3) // DZ (Divided by Zero flag)
-			cpu.wcsr(fcsr, v)
+			// Division by 0.
 			cpu.wxreg(rd, 0xffff_ffff_ffff_ffff)
 		} else {
 			cpu.wxreg(rd, dividend/divisor)
@@ -1178,10 +1773,7 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		dividend := uint32(cpu.rxreg(rs1))
 		divisor := uint32(cpu.rxreg(rs2))
 		if divisor == 0 {
-			// Division by 0. Set a special flag
-			v := cpu.rcsr(fcsr)
-			v = setBit(v, 3) // DZ (Divided by Zero flag)
-			cpu.wcsr(fcsr, v)
+			// Division by 0.
 			cpu.wxreg(rd, 0xffff_ffff_ffff_ffff)
 		} else {
 			cpu.wxreg(rd, uint64(int64(int32(dividend/divisor))))
@@ -1192,10 +1784,7 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		dividend := int32(cpu.rxreg(rs1))
 		divisor := int32(cpu.rxreg(rs2))
 		if divisor == 0 {
-			// Division by 0. Set a special flag
-			v := cpu.rcsr(fcsr)
-			v = setBit(v, 3) // DZ (Divided by Zero flag)
-			cpu.wcsr(fcsr, v)
+			// Division by 0.
 			cpu.wxreg(rd, 0xffff_ffff_ffff_ffff)
 		} else if dividend == math.MinInt32 && divisor == -1 {
 			cpu.wxreg(rd, uint64(int64(dividend)))
@@ -1203,36 +1792,248 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 			cpu.wxreg(rd, uint64(int64(dividend/divisor)))
 		}
 
-	case raw&0xffffffff == 0x00100073: //"ebreak"
-		return &trap{code: breakpoint}
+	case raw&0xffffffff == 0x00100073: //"ebreak"
+		return &trap{code: breakpoint}
+
+	case raw&0xffffffff == 0x00000073: //"ecall"
+		switch cpu.mode {
+		case user:
+			return &trap{code: ecallFromU}
+		case supervisor:
+			return &trap{code: ecallFromS}
+		case machine:
+			return &trap{code: ecallFromM}
+		default:
+			return &trap{code: illegalInst, value: raw}
+		}
+
+	case raw&0xfe00007f == 0x02000053: //"fadd.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.add(cpu.rfreg(rs1), cpu.rfreg(rs2), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00007f == 0x00000053: //"fadd.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.add(cpu.rfreg32(rs1), cpu.rfreg32(rs2), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0707f == 0xe2001053: //"fclass.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		cpu.wxreg(rd, double.classify(cpu.rfreg(rs1)))
+
+	case raw&0xfff0707f == 0xe0001053: //"fclass.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		cpu.wxreg(rd, single.classify(cpu.rfreg32(rs1)))
+
+	case raw&0xfff0007f == 0xd2200053: //"fcvt.d.l"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fromInt(cpu.rxreg(rs1), true, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xd2300053: //"fcvt.d.lu"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fromInt(cpu.rxreg(rs1), false, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0x42000053: //"fcvt.d.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.convert(double, cpu.rfreg32(rs1), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xd2000053: //"fcvt.d.w"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fromInt(uint64(int64(int32(cpu.rxreg(rs1)))), true, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xd2100053: //"fcvt.d.wu"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fromInt(uint64(uint32(cpu.rxreg(rs1))), false, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xc2200053: //"fcvt.l.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.toInt(cpu.rfreg(rs1), rm, 64, true)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xc0200053: //"fcvt.l.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.toInt(cpu.rfreg32(rs1), rm, 64, true)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xc2300053: //"fcvt.lu.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.toInt(cpu.rfreg(rs1), rm, 64, false)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xc0300053: //"fcvt.lu.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.toInt(cpu.rfreg32(rs1), rm, 64, false)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xffffffff == 0x00000073: //"ecall"
-		switch cpu.mode {
-		case user:
-			return &trap{code: ecallFromU}
-		case supervisor:
-			return &trap{code: ecallFromS}
-		case machine:
-			return &trap{code: ecallFromM}
-		default:
-			return &trap{code: illegalInst, value: raw}
+	case raw&0xfff0007f == 0x40100053: //"fcvt.s.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
 		}
+		v, fl := double.convert(single, cpu.rfreg(rs1), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfe00007f == 0x02000053: //"fadd.d"
+	case raw&0xfff0007f == 0xd0200053: //"fcvt.s.l"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fromInt(cpu.rxreg(rs1), true, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0xd2200053: //"fcvt.d.l"
+	case raw&0xfff0007f == 0xd0300053: //"fcvt.s.lu"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fromInt(cpu.rxreg(rs1), false, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0x42000053: //"fcvt.d.s"
+	case raw&0xfff0007f == 0xd0000053: //"fcvt.s.w"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fromInt(uint64(int64(int32(cpu.rxreg(rs1)))), true, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0xd2000053: //"fcvt.d.w"
+	case raw&0xfff0007f == 0xd0100053: //"fcvt.s.wu"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fromInt(uint64(uint32(cpu.rxreg(rs1))), false, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0xd2100053: //"fcvt.d.wu"
+	case raw&0xfff0007f == 0xc2000053: //"fcvt.w.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.toInt(cpu.rfreg(rs1), rm, 32, true)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0x40100053: //"fcvt.s.d"
+	case raw&0xfff0007f == 0xc0000053: //"fcvt.w.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.toInt(cpu.rfreg32(rs1), rm, 32, true)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
-	case raw&0xfff0007f == 0xc2000053: //"fcvt.w.d"
+	case raw&0xfff0007f == 0xc2100053: //"fcvt.wu.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.toInt(cpu.rfreg(rs1), rm, 32, false)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0xc0100053: //"fcvt.wu.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.toInt(cpu.rfreg32(rs1), rm, 32, false)
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0xfe00007f == 0x1a000053: //"fdiv.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.div(cpu.rfreg(rs1), cpu.rfreg(rs2), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00007f == 0x18000053: //"fdiv.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.div(cpu.rfreg32(rs1), cpu.rfreg32(rs2), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0000707f == 0x0000000f: //"fence"
 		// do nothing because rv currently does not apply any optimizations and no fence is needed.
@@ -1241,48 +2042,291 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		// do nothing because rv currently does not apply any optimizations and no fence is needed.
 
 	case raw&0xfe00707f == 0xa2002053: //"feq.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := double.eq(cpu.rfreg(rs1), cpu.rfreg(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0xa0002053: //"feq.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := single.eq(cpu.rfreg32(rs1), cpu.rfreg32(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0000707f == 0x00003007: //"fld"
+		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
+		v, excp := cpu.read(cpu.rxreg(rs1)+imm, doubleword)
+		if excp != nil {
+			return excp
+		}
+		cpu.wfreg(rd, v)
 
 	case raw&0xfe00707f == 0xa2000053: //"fle.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := double.le(cpu.rfreg(rs1), cpu.rfreg(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0xa0000053: //"fle.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := single.le(cpu.rfreg32(rs1), cpu.rfreg32(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0xfe00707f == 0xa2001053: //"flt.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := double.lt(cpu.rfreg(rs1), cpu.rfreg(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0xa0001053: //"flt.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := single.lt(cpu.rfreg32(rs1), cpu.rfreg32(rs2))
+		cpu.wxreg(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0000707f == 0x00002007: //"flw"
+		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
+		v, excp := cpu.read(cpu.rxreg(rs1)+imm, word)
+		if excp != nil {
+			return excp
+		}
+		cpu.wfreg32(rd, v)
 
 	case raw&0x0600007f == 0x02000043: //"fmadd.d"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fma(cpu.rfreg(rs1), cpu.rfreg(rs2), cpu.rfreg(rs3), false, false, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0x0600007f == 0x00000043: //"fmadd.s"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fma(cpu.rfreg32(rs1), cpu.rfreg32(rs2), cpu.rfreg32(rs3), false, false, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0x2a001053: //"fmax.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := double.minmax(cpu.rfreg(rs1), cpu.rfreg(rs2), true)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0x28001053: //"fmax.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := single.minmax(cpu.rfreg32(rs1), cpu.rfreg32(rs2), true)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0x2a000053: //"fmin.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := double.minmax(cpu.rfreg(rs1), cpu.rfreg(rs2), false)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00707f == 0x28000053: //"fmin.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		v, fl := single.minmax(cpu.rfreg32(rs1), cpu.rfreg32(rs2), false)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0x0600007f == 0x02000047: //"fmsub.d"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fma(cpu.rfreg(rs1), cpu.rfreg(rs2), cpu.rfreg(rs3), false, true, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0x0600007f == 0x00000047: //"fmsub.s"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fma(cpu.rfreg32(rs1), cpu.rfreg32(rs2), cpu.rfreg32(rs3), false, true, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0xfe00007f == 0x12000053: //"fmul.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.mul(cpu.rfreg(rs1), cpu.rfreg(rs2), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00007f == 0x10000053: //"fmul.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.mul(cpu.rfreg32(rs1), cpu.rfreg32(rs2), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0xfff0707f == 0xf2000053: //"fmv.d.x"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		cpu.wfreg(rd, cpu.rxreg(rs1))
+
+	case raw&0xfff0707f == 0xf0000053: //"fmv.w.x"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		cpu.wfreg32(rd, cpu.rxreg(rs1))
 
 	case raw&0xfff0707f == 0xe2000053: //"fmv.x.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		cpu.wxreg(rd, cpu.rfreg(rs1))
 
 	case raw&0xfff0707f == 0xe0000053: //"fmv.x.w"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		// the bits are moved as they are, without checking NaN-boxing
+		cpu.wxreg(rd, uint64(int64(int32(cpu.rfreg(rs1)))))
 
-	case raw&0xfff0707f == 0xf0000053: //"fmv.w.x"
+	case raw&0x0600007f == 0x0200004f: //"fnmadd.d"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fma(cpu.rfreg(rs1), cpu.rfreg(rs2), cpu.rfreg(rs3), true, true, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0x0600007f == 0x0000004f: //"fnmadd.s"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fma(cpu.rfreg32(rs1), cpu.rfreg32(rs2), cpu.rfreg32(rs3), true, true, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0600007f == 0x0200004b: //"fnmsub.d"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.fma(cpu.rfreg(rs1), cpu.rfreg(rs2), cpu.rfreg(rs3), true, false, rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0x0600007f == 0x0000004b: //"fnmsub.s"
+		rd, rs1, rs2, rs3 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20), bits(raw, 31, 27)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.fma(cpu.rfreg32(rs1), cpu.rfreg32(rs2), cpu.rfreg32(rs3), true, false, rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0000707f == 0x00003027: //"fsd"
+		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
+		addr := cpu.rxreg(rs1) + imm
+		if excp := cpu.write(addr, cpu.rfreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 
 	case raw&0xfe00707f == 0x22000053: //"fsgnj.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg(rs1), cpu.rfreg(rs2)
+		cpu.wfreg(rd, (a&0x7fffffff_ffffffff)|(b&0x80000000_00000000))
+
+	case raw&0xfe00707f == 0x20000053: //"fsgnj.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg32(rs1), cpu.rfreg32(rs2)
+		cpu.wfreg32(rd, (a&0x7fffffff)|(b&0x80000000))
+
+	case raw&0xfe00707f == 0x22001053: //"fsgnjn.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg(rs1), cpu.rfreg(rs2)
+		cpu.wfreg(rd, (a&0x7fffffff_ffffffff)|(^b&0x80000000_00000000))
+
+	case raw&0xfe00707f == 0x20001053: //"fsgnjn.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg32(rs1), cpu.rfreg32(rs2)
+		cpu.wfreg32(rd, (a&0x7fffffff)|(^b&0x80000000))
 
 	case raw&0xfe00707f == 0x22002053: //"fsgnjx.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg(rs1), cpu.rfreg(rs2)
+		cpu.wfreg(rd, a^(b&0x80000000_00000000))
+
+	case raw&0xfe00707f == 0x20002053: //"fsgnjx.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		a, b := cpu.rfreg32(rs1), cpu.rfreg32(rs2)
+		cpu.wfreg32(rd, a^(b&0x80000000))
+
+	case raw&0xfff0007f == 0x5a000053: //"fsqrt.d"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.sqrt(cpu.rfreg(rs1), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfff0007f == 0x58000053: //"fsqrt.s"
+		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.sqrt(cpu.rfreg32(rs1), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0xfe00007f == 0x0a000053: //"fsub.d"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := double.sub(cpu.rfreg(rs1), cpu.rfreg(rs2), rm)
+		cpu.wfreg(rd, v)
+		cpu.setFflags(fl)
+
+	case raw&0xfe00007f == 0x08000053: //"fsub.s"
+		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
+		rm, excp := cpu.roundingMode(raw)
+		if excp != nil {
+			return excp
+		}
+		v, fl := single.sub(cpu.rfreg32(rs1), cpu.rfreg32(rs2), rm)
+		cpu.wfreg32(rd, v)
+		cpu.setFflags(fl)
 
 	case raw&0x0000707f == 0x00002027: //"fsw"
+		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
+		addr := cpu.rxreg(rs1) + imm
+		if excp := cpu.write(addr, cpu.rfreg(rs2), word); excp != nil {
+			return excp
+		}
 
 	case raw&0x0000007f == 0x0000006f: //"jal"
 		rd, imm := bits(raw, 11, 7), parseJImm(raw)
-		tmp := pc + 4
+		tmp := cpu.pc // the next instruction, which is pc+2 for C.JAL
 		cpu.wxreg(rd, tmp)
 		cpu.pc = pc + imm
 
 	case raw&0x0000707f == 0x00000067: //"jalr"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
-		tmp := pc + 4
+		tmp := cpu.pc // the next instruction, which is pc+2 for C.JALR
 		target := (cpu.rxreg(rs1) + imm) & ^uint64(1)
 		cpu.pc = target
 		cpu.wxreg(rd, tmp)
@@ -1331,16 +2375,24 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0xf9f0707f == 0x1000302f: //"lr.d"
 		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
 		addr := cpu.rxreg(rs1)
+		if misaligned(addr, doubleword) {
+			return &trap{code: loadAddrMisaligned, value: addr}
+		}
+
 		t, excp := cpu.read(addr, doubleword)
 		if excp != nil {
 			return excp
 		}
-		cpu.wxreg(rd, uint64(int64(int32(t))))
+		cpu.wxreg(rd, t)
 		cpu.reserve(addr)
 
 	case raw&0xf9f0707f == 0x1000202f: //"lr.w"
 		rd, rs1 := bits(raw, 11, 7), bits(raw, 19, 15)
 		addr := cpu.rxreg(rs1)
+		if misaligned(addr, word) {
+			return &trap{code: loadAddrMisaligned, value: addr}
+		}
+
 		t, excp := cpu.read(addr, word)
 		if excp != nil {
 			return excp
@@ -1415,6 +2467,10 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		cpu.wxreg(rd, uint64(int64(int32(cpu.rxreg(rs1))*int32(cpu.rxreg(rs2)))))
 
 	case raw&0xffffffff == 0x30200073: //"mret"
+		if cpu.mode < machine {
+			return &trap{code: illegalInst, value: raw}
+		}
+
 		// First, set CSRs[MEPC] to program counter.
 		cpu.pc = cpu.rcsr(mepc)
 
@@ -1424,17 +2480,15 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 
 		// Set CPU mode according to MPP
 		switch bits(mst, 12, 11) {
-		case 0b00:
-			cpu.mode = user
-			mst = clearBit(mst, 17)
 		case 0b01:
 			cpu.mode = supervisor
 			mst = clearBit(mst, 17)
 		case 0b11:
 			cpu.mode = machine
 		default:
-			// should not happen
-			panic("invalid CSR MPP")
+			// 0b00, or 0b10 which legalizeMstatus never lets mstatus hold.
+			cpu.mode = user
+			mst = clearBit(mst, 17)
 		}
 
 		mpie := bit(mst, 7)
@@ -1517,31 +2571,43 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00000023: //"sb"
 		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
 		addr := cpu.rxreg(rs1) + imm
-		cpu.write(addr, cpu.rxreg(rs2), byt)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), byt); excp != nil {
+			return excp
+		}
 
 	case raw&0xf800707f == 0x1800302f: //"sc.d"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
+		if misaligned(addr, doubleword) {
+			return &trap{code: storeAddrMisaligned, value: addr}
+		}
 
 		if cpu.reserved(addr) {
 			// SC succeeds.
-			cpu.write(addr, cpu.rxreg(rs2), doubleword)
+			cpu.cancel(addr)
+			if excp := cpu.write(addr, cpu.rxreg(rs2), doubleword); excp != nil {
+				return excp
+			}
 			cpu.wxreg(rd, 0)
 		} else {
 			// SC fails.
+			cpu.cancel(addr)
 			cpu.wxreg(rd, 1)
 		}
 
-		cpu.cancel(addr)
-
 	case raw&0xf800707f == 0x1800202f: //"sc.w"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
 		addr := cpu.rxreg(rs1)
+		if misaligned(addr, word) {
+			return &trap{code: storeAddrMisaligned, value: addr}
+		}
 
 		if cpu.reserved(addr) {
 			// SC succeeds.
 			cpu.cancel(addr)
-			cpu.write(addr, cpu.rxreg(rs2), word)
+			if excp := cpu.write(addr, cpu.rxreg(rs2), word); excp != nil {
+				return excp
+			}
 			cpu.wxreg(rd, 0)
 		} else {
 			// SC fails.
@@ -1552,15 +2618,25 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00003023: //"sd"
 		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
 		addr := cpu.rxreg(rs1) + imm
-		cpu.write(addr, cpu.rxreg(rs2), doubleword)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), doubleword); excp != nil {
+			return excp
+		}
 
 	case raw&0xfe007fff == 0x12000073: //"sfence.vma"
-		// do nothing because rv currently does not apply any optimizations and no fence is needed.
+		// mstatus.TVM traps sfence.vma in S-mode.
+		if cpu.mode < supervisor || (cpu.mode == supervisor && bit(cpu.csr[mstatus], 20) == 1) {
+			return &trap{code: illegalInst, value: raw}
+		}
+
+		rs1, rs2 := bits(raw, 19, 15), bits(raw, 24, 20)
+		cpu.tlb.flush(cpu.getEffectiveAddr(cpu.rxreg(rs1))>>12, rs1 != 0, cpu.rxreg(rs2)&0xffff, rs2 != 0)
 
 	case raw&0x0000707f == 0x00001023: //"sh"
 		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
 		addr := cpu.rxreg(rs1) + imm
-		cpu.write(addr, cpu.rxreg(rs2), halfword)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), halfword); excp != nil {
+			return excp
+		}
 
 	case raw&0xfe00707f == 0x00001033: //"sll"
 		rd, rs1, rs2 := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 24, 20)
@@ -1621,11 +2697,10 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		cpu.wxreg(rd, uint64(int64(cpu.rxreg(rs1))>>shift))
 
 	case raw&0xfc00707f == 0x40005013: //"srai"
-		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
-		shamt := imm & 0b1_1111
+		rd, rs1, shamt := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 25, 20)
 		cpu.wxreg(rd, uint64(int64(cpu.rxreg(rs1))>>shamt))
 
-	case raw&0xfc00707f == 0x4000501b: //"sraiw"
+	case raw&0xfe00707f == 0x4000501b: //"sraiw"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		shamt := imm & 0b1_1111
 		cpu.wxreg(rd, uint64(int64(int32(cpu.rxreg(rs1))>>shamt)))
@@ -1636,6 +2711,11 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		cpu.wxreg(rd, uint64(int64(int32(cpu.rxreg(rs1))>>shamt)))
 
 	case raw&0xffffffff == 0x10200073: //"sret"
+		// mstatus.TSR traps sret in S-mode.
+		if cpu.mode < supervisor || (cpu.mode == supervisor && bit(cpu.csr[mstatus], 22) == 1) {
+			return &trap{code: illegalInst, value: raw}
+		}
+
 		cpu.pc = cpu.rcsr(sepc)
 
 		// Then, Modify SSTATUS.
@@ -1643,30 +2723,22 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		sst := cpu.rcsr(sstatus)
 
 		// Set CPU mode according to SPP
-		switch bit(sst, 8) {
-		case 0b0:
-			cpu.mode = user
-		case 0b1:
+		if bit(sst, 8) == 1 {
 			cpu.mode = supervisor
-
-			// MPRV must be set 0 if the mode is not Machine.
-			if cpu.mode == supervisor {
-				mst := cpu.rcsr(mstatus)
-				mst = clearBit(mst, 17)
-				cpu.wcsr(mstatus, mst)
-			}
-		default:
-			// should not happen
-			panic("invalid CSR SPP")
+		} else {
+			cpu.mode = user
 		}
 
-		spie := bit(sstatus, 5)
+		// MPRV must be set 0 if the mode is not Machine.
+		cpu.wcsr(mstatus, clearBit(cpu.rcsr(mstatus), 17))
+
+		spie := bit(sst, 5)
 
 		// set SPIE to SIE
 		if spie == 0 {
-			sst = clearBit(sstatus, 1)
+			sst = clearBit(sst, 1)
 		} else {
-			sst = setBit(sstatus, 1)
+			sst = setBit(sst, 1)
 		}
 
 		// set 1 to SPIE
@@ -1684,11 +2756,10 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 		cpu.wxreg(rd, cpu.rxreg(rs1)>>shift)
 
 	case raw&0xfc00707f == 0x00005013: //"srli"
-		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
-		shamt := imm & 0b1_1111
+		rd, rs1, shamt := bits(raw, 11, 7), bits(raw, 19, 15), bits(raw, 25, 20)
 		cpu.wxreg(rd, cpu.rxreg(rs1)>>shamt)
 
-	case raw&0xfc00707f == 0x0000501b: //"srliw"
+	case raw&0xfe00707f == 0x0000501b: //"srliw"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		shamt := imm & 0b1_1111
 		cpu.wxreg(rd, uint64(int64(int32(uint32(cpu.rxreg(rs1))>>shamt))))
@@ -1709,26 +2780,16 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00002023: //"sw"
 		rs1, rs2, imm := bits(raw, 19, 15), bits(raw, 24, 20), parseSImm(raw)
 		addr := cpu.rxreg(rs1) + imm
-		cpu.write(addr, cpu.rxreg(rs2), word)
-
-	case raw&0xffffffff == 0x00200073: //"uret"
-		ust := cpu.rcsr(ustatus)
-		upie := bit(ust, 4)
-
-		// set UPIE to UIE
-		if upie == 0 {
-			ust = clearBit(ust, 0)
-		} else {
-			ust = setBit(ust, 0)
+		if excp := cpu.write(addr, cpu.rxreg(rs2), word); excp != nil {
+			return excp
 		}
 
-		// set 1 to SPIE
-		ust = setBit(ust, 4)
-
-		// update USTATUS
-		cpu.wcsr(ustatus, ust)
-
 	case raw&0xffffffff == 0x10500073: //"wfi"
+		// wfi is illegal in U-mode, and mstatus.TW traps it in S-mode.
+		if cpu.mode < supervisor || (cpu.mode == supervisor && bit(cpu.csr[mstatus], 21) == 1) {
+			return &trap{code: illegalInst, value: raw}
+		}
+
 		cpu.wfi = true
 
 	case raw&0xfe00707f == 0x00004033: //"xor"
@@ -1738,11 +2799,31 @@ func (cpu *CPU) exec(raw, pc uint64) *trap {
 	case raw&0x0000707f == 0x00004013: //"xori"
 		rd, rs1, imm := bits(raw, 11, 7), bits(raw, 19, 15), parseIImm(raw)
 		cpu.wxreg(rd, cpu.rxreg(rs1)^imm)
+
+	default:
+		// unknown opcode or reserved encoding
+		return &trap{code: illegalInst, value: raw}
 	}
 
 	return nil
 }
 
+// isFPInst returns true if the instruction belongs to F or D extension.
+func isFPInst(raw uint64) bool {
+	switch raw & 0x7f {
+	case 0x07, // LOAD-FP
+		0x27, // STORE-FP
+		0x43, // MADD
+		0x47, // MSUB
+		0x4b, // NMSUB
+		0x4f, // NMADD
+		0x53: // OP-FP
+		return true
+	}
+
+	return false
+}
+
 func (cpu *CPU) getCause(code int, intr bool) uint64 {
 	if !intr {
 		return uint64(code)
@@ -1760,21 +2841,18 @@ func (cpu *CPU) handleTrap(trp *trap, curPC uint64, intr bool) bool {
 	curMode := cpu.mode
 	cause := cpu.getCause(trp.code, intr)
 
-	var mdeleg, sdeleg uint64
+	var mdeleg uint64
 	if intr {
 		mdeleg = cpu.rcsr(mideleg)
-		sdeleg = cpu.rcsr(sideleg)
 	} else {
 		mdeleg = cpu.rcsr(medeleg)
-		sdeleg = cpu.rcsr(sedeleg)
 	}
 
 	pos := cause & 0xffff
 
-	newMode := user
-	if ((mdeleg >> pos) & 1) == 0 {
-		newMode = machine
-	} else if ((sdeleg >> pos) & 1) == 0 {
+	// Traps never go to U-mode, as there is no N extension to delegate them further from S-mode.
+	newMode := machine
+	if ((mdeleg >> pos) & 1) == 1 {
 		newMode = supervisor
 	}
 
@@ -1795,8 +2873,6 @@ func (cpu *CPU) handleTrap(trp *trap, curPC uint64, intr bool) bool {
 			ie = cpu.rcsr(mie)
 		case supervisor:
 			ie = cpu.rcsr(sie)
-		case user:
-			ie = cpu.rcsr(uie)
 		}
 
 		curMIE := (curStatus >> 3) & 1
@@ -1883,8 +2959,6 @@ func (cpu *CPU) handleTrap(trp *trap, curPC uint64, intr bool) bool {
 		epcAddr, causeAddr, tvalAddr, tvecAddr = mepc, mcause, mtval, mtvec
 	case supervisor:
 		epcAddr, causeAddr, tvalAddr, tvecAddr = sepc, scause, stval, stvec
-	case user:
-		epcAddr, causeAddr, tvalAddr, tvecAddr = uepc, ucause, utval, utvec
 	}
 
 	cpu.wcsr(epcAddr, curPC)
@@ -1907,8 +2981,6 @@ func (cpu *CPU) handleTrap(trp *trap, curPC uint64, intr bool) bool {
 		sie := (status >> 1) & 1
 		newStatus := (status & ^uint64(0x122)) | (sie << uint64(5)) | ((uint64(curMode) & 1) << 8)
 		cpu.wcsr(sstatus, newStatus)
-	case user:
-		panic("unimplemented")
 	}
 
 	return true
@@ -1922,40 +2994,40 @@ func (cpu *CPU) handleIntr(pc uint64) {
 	mint := cpu.rcsr(mip) & cpu.rcsr(mie)
 
 	if mint&0x800 != 0 { // meip
+		// meip is cleared by claiming the interrupt from the PLIC.
 		if cpu.handleTrap(&trap{code: machineExternalIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x7ff)
 			cpu.wfi = false
 			return
 		}
 	}
 
 	if mint&0x008 != 0 { // msip
+		// msip is cleared by writing to the CLINT.
 		if cpu.handleTrap(&trap{code: machineSoftwareIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x0111)
 			cpu.wfi = false
 			return
 		}
 	}
 
 	if mint&0x080 != 0 { // mtip
+		// mtip is cleared by writing to mtimecmp.
 		if cpu.handleTrap(&trap{code: machineTimerIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x7f)
 			cpu.wfi = false
 			return
 		}
 	}
 
 	if mint&0x200 != 0 { // seip
+		// seip is cleared by claiming the interrupt from the PLIC.
 		if cpu.handleTrap(&trap{code: supervisorExternalIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x1ff)
 			cpu.wfi = false
 			return
 		}
 	}
 
 	if mint&0x002 != 0 { // ssip
+		// ssip and stip are cleared by software writing to mip or sip.
 		if cpu.handleTrap(&trap{code: supervisorSoftwareIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x1)
 			cpu.wfi = false
 			return
 		}
@@ -1963,7 +3035,6 @@ func (cpu *CPU) handleIntr(pc uint64) {
 
 	if mint&0x020 != 0 { // stip
 		if cpu.handleTrap(&trap{code: supervisorTimerIntr}, pc, true) {
-			cpu.wcsr(mip, cpu.rcsr(mip)&0x1f)
 			cpu.wfi = false
 			return
 		}
@@ -0,0 +1,441 @@
+package main
+
+import "testing"
+
+func TestMisaligned(t *testing.T) {
+	cpu := NewCPU(0x2000)
+	end := uint64(drambase + 0x2000)
+
+	// emulated across the page boundary
+	if excp := cpu.write(drambase+0xffd, 0x0807060504030201, doubleword); excp != nil {
+		t.Fatalf("write: %+v", excp)
+	}
+	if got, excp := cpu.read(drambase+0xffd, doubleword); excp != nil || got != 0x0807060504030201 {
+		t.Fatalf("read: got %#x, %+v", got, excp)
+	}
+
+	// a store partially out of the memory does not write anything
+	excp := cpu.write(end-2, 0xffff_ffff, word)
+	if excp == nil || excp.code != storeAccessFault || excp.value != end {
+		t.Fatalf("write out of memory: %+v", excp)
+	}
+	if got := cpu.ram.Read(end-2, halfword); got != 0 {
+		t.Fatalf("partially written: %#x", got)
+	}
+
+	// AMOs always trap
+	if _, excp := cpu.readAMO(drambase+4, doubleword); excp == nil || excp.code != storeAddrMisaligned || excp.value != drambase+4 {
+		t.Fatalf("amo: %+v", excp)
+	}
+
+	cpu.trapMisaligned = true
+	if _, excp := cpu.read(drambase+1, halfword); excp == nil || excp.code != loadAddrMisaligned || excp.value != drambase+1 {
+		t.Fatalf("read: %+v", excp)
+	}
+	if excp := cpu.write(drambase+2, 0, word); excp == nil || excp.code != storeAddrMisaligned || excp.value != drambase+2 {
+		t.Fatalf("write: %+v", excp)
+	}
+	if _, excp := cpu.read(drambase+8, doubleword); excp != nil {
+		t.Fatalf("aligned read: %+v", excp)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	const root = drambase + 0x10000
+
+	tests := []struct {
+		name    string
+		mode    uint64 // satp.MODE
+		levels  int
+		leaf    int // level of the leaf PTE
+		va, pa  uint64
+		want    uint64
+		wantErr bool
+	}{
+		{"sv39 4K", 8, 3, 0, 0x12_3456_7000, drambase + 0x5000, drambase + 0x5000, false},
+		{"sv48 4K", 9, 4, 0, 0x1234_5678_9000, drambase + 0x5000, drambase + 0x5000, false},
+		{"sv48 1G", 9, 4, 2, 0x1234_4567_8abc, drambase, drambase + 0x0567_8abc, false},
+		{"sv57 4K", 10, 5, 0, 0xff_1234_5678_9abc, drambase + 0x5000, drambase + 0x5abc, false},
+		{"sv57 512G", 10, 5, 3, 0xff_0000_0000_1000, 0x80_0000_0000, 0x80_0000_1000, false},
+		{"sv57 misaligned 2M", 10, 5, 1, 0xff_0000_0000_1000, drambase + 0x1000, 0, true},
+		{"sv48 non-canonical", 9, 4, 0, 0x8000_0000_0000, drambase, 0, true},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			allowAll(cpu)
+			table := uint64(root)
+			for l := tc.levels - 1; l > tc.leaf; l-- {
+				next := table + 0x1000
+				cpu.ram.Write(table+((tc.va>>(12+9*l))&0x1ff)*8, (next>>12)<<10|1, doubleword)
+				table = next
+			}
+			cpu.ram.Write(table+((tc.va>>(12+9*tc.leaf))&0x1ff)*8, (tc.pa>>12)<<10|0xcf, doubleword) // DA-XWRV
+
+			cpu.wcsr(satp, tc.mode<<60|root>>12)
+			cpu.mode = supervisor
+
+			got, excp := cpu.translate(tc.va, maLoad)
+			if tc.wantErr {
+				if excp == nil || excp.code != loadPageFault || excp.value != tc.va {
+					t.Fatalf("want load page fault, got %#x, %+v", got, excp)
+				}
+				return
+			}
+			if excp != nil || got != tc.want {
+				t.Fatalf("want %#x, got %#x, %+v", tc.want, got, excp)
+			}
+		})
+	}
+
+	// unsupported mode is ignored
+	cpu := NewCPU(defaultRAMSize)
+	cpu.wcsr(satp, 9<<60|root>>12)
+	cpu.wcsr(satp, 11<<60)
+	if got := cpu.rcsr(satp); got != 9<<60|root>>12 || cpu.addressingMode != sv48 {
+		t.Fatalf("satp must not be changed: %#x", got)
+	}
+}
+
+func TestPagePermission(t *testing.T) {
+	const (
+		root = drambase + 0x10000
+		va   = 0x1000
+		sum  = 1 << 18
+		mxr  = 1 << 19
+		mprv = 1 << 17
+	)
+
+	tests := []struct {
+		name    string
+		pte     uint64 // flags of the leaf PTE
+		nonLeaf uint64 // flags added to the non-leaf PTEs
+		mode    int
+		mstatus uint64
+		menvcfg uint64
+		ma      int
+		ok      bool
+	}{
+		{"user page from S-mode", pteU | pteA | pteR | pteV, 0, supervisor, 0, menvcfgADUE, maLoad, false},
+		{"user page from S-mode with SUM", pteU | pteA | pteR | pteV, 0, supervisor, sum, menvcfgADUE, maLoad, true},
+		{"user page executed in S-mode with SUM", pteU | pteA | pteX | pteV, 0, supervisor, sum, menvcfgADUE, maInst, false},
+		{"supervisor page from U-mode", pteA | pteR | pteV, 0, user, 0, menvcfgADUE, maLoad, false},
+		{"user page from U-mode", pteU | pteA | pteR | pteV, 0, user, 0, menvcfgADUE, maLoad, true},
+		{"execute-only page", pteA | pteX | pteV, 0, supervisor, 0, menvcfgADUE, maLoad, false},
+		{"execute-only page with MXR", pteA | pteX | pteV, 0, supervisor, mxr, menvcfgADUE, maLoad, true},
+		{"user page with MPRV", pteU | pteA | pteR | pteV, 0, machine, mprv | 1<<11, menvcfgADUE, maLoad, false},
+		{"A bit clear with Svade", pteR | pteV, 0, supervisor, 0, 0, maLoad, false},
+		{"D bit clear with Svade", pteA | pteR | pteW | pteV, 0, supervisor, 0, 0, maStore, false},
+		{"D bit set with Svade", pteD | pteA | pteR | pteW | pteV, 0, supervisor, 0, 0, maStore, true},
+		{"reserved bit", 1<<60 | pteA | pteR | pteV, 0, supervisor, 0, menvcfgADUE, maLoad, false},
+		{"A bit in non-leaf PTE", pteA | pteR | pteV, pteA, supervisor, 0, menvcfgADUE, maLoad, false},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			allowAll(cpu)
+			table := uint64(root)
+			for l := 2; l > 0; l-- {
+				next := table + 0x1000
+				cpu.ram.Write(table+((va>>(12+9*l))&0x1ff)*8, (next>>12)<<10|tc.nonLeaf|pteV, doubleword)
+				table = next
+			}
+			cpu.ram.Write(table+((va>>12)&0x1ff)*8, (drambase>>12)<<10|tc.pte, doubleword)
+
+			cpu.wcsr(satp, 8<<60|root>>12)
+			cpu.wcsr(mstatus, tc.mstatus)
+			cpu.wcsr(menvcfg, tc.menvcfg)
+			cpu.mode = tc.mode
+
+			_, excp := cpu.translate(va, tc.ma)
+			if tc.ok && excp != nil {
+				t.Fatalf("unexpected fault: %+v", excp)
+			}
+			if !tc.ok && (excp == nil || excp.code != pageFault(tc.ma, va).code) {
+				t.Fatalf("want page fault, got %+v", excp)
+			}
+		})
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+
+	tests := []struct {
+		inst uint64
+		want uint64
+	}{
+		{0x1fe8, 0x3fc10513}, // c.addi4spn a0, sp, 1020
+		{0x3de8, 0x0f85b507}, // c.fld fa0, 248(a1)
+		{0x5de8, 0x07c5a503}, // c.lw a0, 124(a1)
+		{0x7de8, 0x0f85b503}, // c.ld a0, 248(a1)
+		{0xbde8, 0x0ea5bc27}, // c.fsd fa0, 248(a1)
+		{0xdde8, 0x06a5ae23}, // c.sw a0, 124(a1)
+		{0xfde8, 0x0ea5bc23}, // c.sd a0, 248(a1)
+		{0x0001, 0x00000013}, // c.nop
+		{0x1501, 0xfe050513}, // c.addi a0, -32
+		{0x257d, 0x01f5051b}, // c.addiw a0, 31
+		{0x557d, 0xfff00513}, // c.li a0, -1
+		{0x7101, 0xe0010113}, // c.addi16sp sp, -512
+		{0x617d, 0x1f010113}, // c.addi16sp sp, 496
+		{0x7501, 0xfffe0537}, // c.lui a0, 0xfffe0
+		{0x657d, 0x0001f537}, // c.lui a0, 31
+		{0x917d, 0x03f55513}, // c.srli a0, 63
+		{0x8505, 0x40155513}, // c.srai a0, 1
+		{0x997d, 0xfff57513}, // c.andi a0, -1
+		{0x8d0d, 0x40b50533}, // c.sub a0, a1
+		{0x8d2d, 0x00b54533}, // c.xor a0, a1
+		{0x8d4d, 0x00b56533}, // c.or a0, a1
+		{0x8d6d, 0x00b57533}, // c.and a0, a1
+		{0x9d0d, 0x40b5053b}, // c.subw a0, a1
+		{0x9d2d, 0x00b5053b}, // c.addw a0, a1
+		{0xb001, 0x801ff06f}, // c.j -2048
+		{0xaffd, 0x7fe0006f}, // c.j 2046
+		{0xd101, 0xf00500e3}, // c.beqz a0, -256
+		{0xed7d, 0x0e051f63}, // c.bnez a0, 254
+		{0x157e, 0x03f51513}, // c.slli a0, 63
+		{0x357e, 0x1f813507}, // c.fldsp fa0, 504(sp)
+		{0x557e, 0x0fc12503}, // c.lwsp a0, 252(sp)
+		{0x757e, 0x1f813503}, // c.ldsp a0, 504(sp)
+		{0x8502, 0x00050067}, // c.jr a0
+		{0x852e, 0x00b00533}, // c.mv a0, a1
+		{0x9002, 0x00100073}, // c.ebreak
+		{0x9502, 0x000500e7}, // c.jalr a0
+		{0x952e, 0x00b50533}, // c.add a0, a1
+		{0xbfaa, 0x1ea13c27}, // c.fsdsp fa0, 504(sp)
+		{0xdfaa, 0x0ea12e23}, // c.swsp a0, 252(sp)
+		{0xffaa, 0x1ea13c23}, // c.sdsp a0, 504(sp)
+
+		// reserved encodings are illegal
+		{0x0000, 0}, // all zeros
+		{0x8000, 0}, // quadrant 0, funct3 = 4
+		{0x2005, 0}, // c.addiw with rd = 0
+		{0x6101, 0}, // c.addi16sp with nzimm = 0
+		{0x6501, 0}, // c.lui with nzimm = 0
+		{0x9d4d, 0}, // c.subw/c.addw with funct2 = 2
+		{0x9d6d, 0}, // c.subw/c.addw with funct2 = 3
+		{0x8002, 0}, // c.jr with rs1 = 0
+		{0x4002, 0}, // c.lwsp with rd = 0
+		{0x6002, 0}, // c.ldsp with rd = 0
+	}
+
+	for _, tc := range tests {
+		if got := cpu.decompress(tc.inst); got != tc.want {
+			t.Errorf("%#04x: want %#08x, got %#08x", tc.inst, tc.want, got)
+		}
+	}
+
+	// a reserved encoding raises an illegal instruction exception with the 16-bit instruction.
+	cpu.ram.Write(drambase, 0x6501, halfword)
+	cpu.pc = drambase
+	if excp := cpu.run(); excp == nil || excp.code != illegalInst || excp.value != 0x6501 {
+		t.Fatalf("want illegal instruction, got %+v", excp)
+	}
+}
+
+func TestLRSC(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	cpu.xregs[11] = drambase
+	cpu.xregs[12] = 0x1122_3344_5566_7788
+	cpu.ram.Write(drambase, 0x8000_0001_8000_0002, doubleword)
+
+	// lr.d loads all the 64 bits.
+	if excp := cpu.exec(0x1005b52f, drambase); excp != nil { // lr.d a0, (a1)
+		t.Fatalf("lr.d: %+v", excp)
+	}
+	if got := cpu.xregs[10]; got != 0x8000_0001_8000_0002 {
+		t.Fatalf("lr.d: want %#x, got %#x", uint64(0x8000_0001_8000_0002), got)
+	}
+
+	// lr.w sign-extends the word.
+	if excp := cpu.exec(0x1005a52f, drambase); excp != nil { // lr.w a0, (a1)
+		t.Fatalf("lr.w: %+v", excp)
+	}
+	if got := cpu.xregs[10]; got != 0xffff_ffff_8000_0002 {
+		t.Fatalf("lr.w: want %#x, got %#x", uint64(0xffff_ffff_8000_0002), got)
+	}
+
+	if excp := cpu.exec(0x18c5b52f, drambase); excp != nil || cpu.xregs[10] != 0 { // sc.d a0, a2, (a1)
+		t.Fatalf("sc.d: a0 %d, %+v", cpu.xregs[10], excp)
+	}
+	if got := cpu.ram.Read(drambase, doubleword); got != 0x1122_3344_5566_7788 {
+		t.Fatalf("sc.d: stored %#x", got)
+	}
+
+	// the reservation is consumed.
+	if excp := cpu.exec(0x18c5b52f, drambase); excp != nil || cpu.xregs[10] != 1 {
+		t.Fatalf("second sc.d: a0 %d, %+v", cpu.xregs[10], excp)
+	}
+
+	// a faulting sc.d also drops the reservation, as sc.w does.
+	for _, inst := range []uint64{0x18c5b52f, 0x18c5a52f} { // sc.d, sc.w a0, a2, (a1)
+		cpu.xregs[11] = 0 // nothing is mapped
+		cpu.reserve(0)
+		if excp := cpu.exec(inst, drambase); excp == nil || excp.code != storeAccessFault {
+			t.Fatalf("%#x: want store access fault, got %+v", inst, excp)
+		}
+		if cpu.reserved(0) {
+			t.Fatalf("%#x: reservation is kept after the fault", inst)
+		}
+	}
+}
+
+func TestSupervisorIntrPending(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	cpu.ram.Write(drambase, 0x0000006f, word) // j .
+	cpu.pc = drambase
+	cpu.wcsr(mtvec, drambase+0x100)
+	cpu.wcsr(mie, 1<<supervisorSoftwareIntr)
+	cpu.wcsr(mstatus, 0x8) // MIE
+	cpu.wcsr(mip, 1<<supervisorSoftwareIntr|1<<supervisorTimerIntr|1<<supervisorExternalIntr)
+
+	if err := cpu.tick(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cpu.rcsr(mcause); got != 1<<63|supervisorSoftwareIntr {
+		t.Fatalf("mcause: want SSI, got %#x", got)
+	}
+	// taking the trap does not clear the pending bits written by software.
+	if got := cpu.rcsr(mip); got != 1<<supervisorSoftwareIntr|1<<supervisorTimerIntr|1<<supervisorExternalIntr {
+		t.Fatalf("mip: %#x", got)
+	}
+}
+
+func TestPrivilegedInst(t *testing.T) {
+	const (
+		fs  = 1 << 13 // FS=Initial
+		tvm = 1 << 20
+		tw  = 1 << 21
+		tsr = 1 << 22
+	)
+
+	tests := []struct {
+		name       string
+		mode       int
+		mstatus    uint64
+		mcounteren uint64
+		scounteren uint64
+		inst       uint64
+		ok         bool
+	}{
+		{"csrr mstatus in M", machine, fs, 0, 0, 0x30002573, true},
+		{"csrr mstatus in S", supervisor, fs, 0, 0, 0x30002573, false},
+		{"csrs mstatus, zero in S", supervisor, fs, 0, 0, 0x30002073, false},
+		{"csrr sstatus in S", supervisor, fs, 0, 0, 0x10002573, true},
+		{"csrr sstatus in U", user, fs, 0, 0, 0x10002573, false},
+		{"csrwi sstatus in U", user, fs, 0, 0, 0x10005073, false},
+		{"csrr unknown csr", machine, fs, 0, 0, 0x8c002573, false},
+		{"csrr mvendorid", machine, fs, 0, 0, 0xf1102573, true},
+		{"csrw mvendorid", machine, fs, 0, 0, 0xf1151073, false},
+		{"csrw cycle", machine, fs, 0, 0, 0xc0051073, false},
+		{"csrr mcycle in M", machine, fs, 0, 0, 0xb0002573, true},
+		{"csrr mcycle in S", supervisor, fs, 1, 1, 0xb0002573, false},
+		{"csrr satp in S", supervisor, fs, 0, 0, 0x18002573, true},
+		{"csrr satp in S with TVM", supervisor, fs | tvm, 0, 0, 0x18002573, false},
+		{"csrr satp in M with TVM", machine, fs | tvm, 0, 0, 0x18002573, true},
+		{"csrr fflags", user, fs, 0, 0, 0x00102573, true},
+		{"csrr fflags with FS off", user, 0, 0, 0, 0x00102573, false},
+		{"csrr cycle in S", supervisor, fs, 1, 0, 0xc0002573, true},
+		{"csrr cycle in S without mcounteren", supervisor, fs, 0, 1, 0xc0002573, false},
+		{"csrr cycle in U", user, fs, 1, 1, 0xc0002573, true},
+		{"csrr cycle in U without scounteren", user, fs, 1, 0, 0xc0002573, false},
+		{"csrr time in U without mcounteren", user, fs, 1, 2, 0xc0102573, false},
+		{"csrr time in U", user, fs, 2, 2, 0xc0102573, true},
+		{"sfence.vma in S", supervisor, fs, 0, 0, 0x12000073, true},
+		{"sfence.vma in S with TVM", supervisor, fs | tvm, 0, 0, 0x12000073, false},
+		{"sfence.vma in U", user, fs, 0, 0, 0x12000073, false},
+		{"wfi in M with TW", machine, fs | tw, 0, 0, 0x10500073, true},
+		{"wfi in S", supervisor, fs, 0, 0, 0x10500073, true},
+		{"wfi in S with TW", supervisor, fs | tw, 0, 0, 0x10500073, false},
+		{"wfi in U", user, fs, 0, 0, 0x10500073, false},
+		{"sret in M with TSR", machine, fs | tsr, 0, 0, 0x10200073, true},
+		{"sret in S", supervisor, fs, 0, 0, 0x10200073, true},
+		{"sret in S with TSR", supervisor, fs | tsr, 0, 0, 0x10200073, false},
+		{"sret in U", user, fs, 0, 0, 0x10200073, false},
+		{"mret in M", machine, fs, 0, 0, 0x30200073, true},
+		{"mret in S", supervisor, fs, 0, 0, 0x30200073, false},
+		{"mret in U", user, fs, 0, 0, 0x30200073, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.mode = tc.mode
+			cpu.csr[mstatus] = mstatusxl | tc.mstatus
+			cpu.csr[mcounteren] = tc.mcounteren
+			cpu.csr[scounteren] = tc.scounteren
+
+			excp := cpu.exec(tc.inst, drambase)
+			if tc.ok && excp != nil {
+				t.Fatalf("unexpected trap: %+v", excp)
+			}
+			if !tc.ok && (excp == nil || excp.code != illegalInst || excp.value != tc.inst) {
+				t.Fatalf("want illegal instruction with tval %#x, got %+v", tc.inst, excp)
+			}
+		})
+	}
+}
+
+func TestIllegalInst(t *testing.T) {
+	tests := []struct {
+		name string
+		inst uint64
+		tval uint64
+	}{
+		{"all zeros", 0x00000000, 0},
+		{"all ones", 0xffffffff, 0xffffffff},
+		{"custom-0 opcode", 0x0000000b, 0x0000000b},
+		{"reserved funct7 of sll", 0x40001033, 0x40001033},
+		{"uret without N extension", 0x00200073, 0x00200073},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.ram.Write(drambase, tc.inst, word)
+			cpu.pc = drambase
+			cpu.wcsr(mtvec, drambase+0x100)
+
+			if err := cpu.tick(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if cpu.pc != drambase+0x100 || cpu.rcsr(mcause) != illegalInst || cpu.rcsr(mtval) != tc.tval || cpu.rcsr(mepc) != drambase {
+				t.Fatalf("want illegal instruction trap, got pc %#x mcause %d mtval %#x mepc %#x", cpu.pc, cpu.rcsr(mcause), cpu.rcsr(mtval), cpu.rcsr(mepc))
+			}
+			if cpu.csr[instret] != 0 {
+				t.Fatalf("illegal instruction is retired")
+			}
+
+			// in halt mode, the emulation stops without trapping.
+			cpu = NewCPU(defaultRAMSize)
+			cpu.ram.Write(drambase, tc.inst, word)
+			cpu.pc = drambase
+			cpu.haltOnIllegal = true
+
+			if err := cpu.tick(); err == nil {
+				t.Fatal("want error in halt mode")
+			}
+			if cpu.rcsr(mcause) != 0 || cpu.rcsr(mepc) != 0 {
+				t.Fatalf("trap is taken in halt mode: mcause %d mepc %#x", cpu.rcsr(mcause), cpu.rcsr(mepc))
+			}
+		})
+	}
+}
+
+func TestMretReservedMPP(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	// MPP = 0b10 can't be written by software, but mret must not depend on it.
+	cpu.csr[mstatus] = mstatusxl | 2<<11 | 1<<17
+	cpu.csr[mepc] = drambase + 0x100
+
+	if excp := cpu.exec(0x30200073, drambase); excp != nil { // mret
+		t.Fatalf("unexpected trap: %+v", excp)
+	}
+	if cpu.mode != user || cpu.pc != drambase+0x100 || cpu.csr[mstatus]&(3<<11|1<<17) != 0 {
+		t.Fatalf("want U-mode at %#x with MPP and MPRV cleared, got mode %d at %#x, mstatus %#x", drambase+0x100, cpu.mode, cpu.pc, cpu.csr[mstatus])
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// csrDesc describes how a CSR behaves when it is accessed by csr instructions.
+type csrDesc struct {
+	// alias is the CSR actually holding the value if the CSR is a view of another one
+	// (e.g. sstatus is a view of mstatus). 0 means the CSR holds its own value.
+	alias uint64
+	// shift is the position of the view in the aliased CSR.
+	shift int
+	// rmask is the bits which are visible on read, wmask is the bits which are
+	// writable. Both are in the position of the CSR holding the value.
+	rmask uint64
+	wmask uint64
+	// legalize makes WARL fields hold a legal value. It receives the old and the
+	// new value, and returns the value to be stored.
+	legalize func(old, val uint64) uint64
+	// locked returns the bits which are temporarily read-only, e.g. locked PMP entries.
+	locked func(cpu *CPU) uint64
+	// driven returns the bits driven by devices, which are ORed into the value on read.
+	driven func(cpu *CPU) uint64
+	// update is called after write to apply side effects.
+	// legalize and update of the aliased CSR are used for a view.
+	update func(cpu *CPU)
+}
+
+const (
+	all = ^uint64(0)
+
+	// mstatus fields which are writable: SIE, MIE, SPIE, MPIE, SPP, MPP, FS, MPRV, SUM, MXR, TVM, TW, TSR.
+	mstatuswmask = 0x7e79aa
+	// sstatus fields which are writable: SIE, SPIE, SPP, FS, SUM, MXR.
+	sstatuswmask = 0xc6122
+	// exceptions which can be delegated. ecall from M-mode cannot be.
+	medelegmask = 0xb3ff
+	// interrupts which are implemented: SSI, MSI, STI, MTI, SEI, MEI.
+	mipmask = 0xaaa
+	// menvcfg fields which are writable: FIOM, ADUE.
+	menvcfgwmask = 1<<0 | menvcfgADUE
+	// menvcfg.ADUE enables the hardware update of A and D bits (Svadu), otherwise the access page-faults (Svade).
+	menvcfgADUE = 1 << 61
+	// misa: MXL = 64, extensions = ACDFIMSU
+	misaval = 2<<62 | 1<<0 | 1<<2 | 1<<3 | 1<<5 | 1<<8 | 1<<12 | 1<<18 | 1<<20
+	// mstatus.UXL and SXL are fixed to 64
+	mstatusxl = 2<<32 | 2<<34
+)
+
+var csrs = map[uint64]csrDesc{
+	// floating-point
+	fflags: {alias: fcsr, rmask: 0x1f, wmask: 0x1f},
+	frm:    {alias: fcsr, shift: 5, rmask: 0xe0, wmask: 0xe0},
+	fcsr:   {rmask: 0xff, wmask: 0xff, update: (*CPU).dirtyFS},
+
+	// supervisor
+	sstatus:    {alias: mstatus, rmask: sstatusmask, wmask: sstatuswmask},
+	sie:        {alias: mie, rmask: siemask, wmask: siemask},
+	stvec:      {rmask: all, wmask: all, legalize: legalizeTvec},
+	scounteren: {rmask: all, wmask: 0xffffffff},
+	senvcfg:    {rmask: all, wmask: 0x1}, // FIOM
+	sscratch:   {rmask: all, wmask: all},
+	sepc:       {rmask: all, wmask: ^uint64(1)}, // IALIGN = 16
+	scause:     {rmask: all, wmask: all},
+	stval:      {rmask: all, wmask: all},
+	sip:        {alias: mip, rmask: sipmask, wmask: 0x2}, // only SSIP is writable
+	satp:       {rmask: all, wmask: all, legalize: legalizeSatp, update: func(cpu *CPU) { cpu.updateAddressingMode(cpu.csr[satp]) }},
+
+	// machine
+	mstatus:    {rmask: all, wmask: mstatuswmask, legalize: legalizeMstatus},
+	misa:       {rmask: all, wmask: 0}, // changing extensions is not supported
+	medeleg:    {rmask: all, wmask: medelegmask},
+	mideleg:    {rmask: all, wmask: siemask},
+	mie:        {rmask: all, wmask: mipmask},
+	mtvec:      {rmask: all, wmask: all, legalize: legalizeTvec},
+	mcounteren: {rmask: all, wmask: 0xffffffff},
+	menvcfg:    {rmask: all, wmask: menvcfgwmask},
+	mscratch:   {rmask: all, wmask: all},
+	mepc:       {rmask: all, wmask: ^uint64(1)}, // IALIGN = 16
+	mcause:     {rmask: all, wmask: all},
+	mtval:      {rmask: all, wmask: all},
+	mip:        {rmask: all, wmask: siemask, driven: func(cpu *CPU) uint64 { return cpu.plic.seip() }}, // M-mode bits are set by devices
+	mvendorid:  {rmask: all},
+	marchid:    {rmask: all},
+	mimpid:     {rmask: all},
+	mhartid:    {rmask: all},
+	mconfigptr: {rmask: all},
+
+	// machine counters
+	mcycle:        {alias: cycle, rmask: all, wmask: all},
+	minstret:      {alias: instret, rmask: all, wmask: all},
+	mcountinhibit: {rmask: all}, // counters are never inhibited
+}
+
+func init() {
+	// Odd pmpcfg registers don't exist in RV64.
+	for i := uint64(0); i < pmpEntries/4; i += 2 {
+		i := i
+		csrs[pmpcfg0+i] = csrDesc{
+			rmask:    all,
+			wmask:    pmpcfgwmask,
+			legalize: legalizePmpcfg,
+			locked:   func(cpu *CPU) uint64 { return cpu.pmpcfgLocked(i) },
+			update:   (*CPU).updatePMP,
+		}
+	}
+	for i := uint64(0); i < pmpEntries; i++ {
+		i := i
+		csrs[pmpaddr0+i] = csrDesc{
+			rmask: all,
+			wmask: pmpaddrwmask,
+			locked: func(cpu *CPU) uint64 {
+				if cpu.pmpaddrLocked(i) {
+					return all
+				}
+				return 0
+			},
+			update: (*CPU).updatePMP,
+		}
+	}
+
+	// cycle, time, instret and hpmcounter3-31
+	for i := uint64(0); i < 32; i++ {
+		csrs[cycle+i] = csrDesc{rmask: all}
+	}
+	// The counters are incremented after the instruction writing mcycle or minstret retires,
+	// so the written value is decremented to be seen by the next instruction.
+	csrs[cycle] = csrDesc{rmask: all, update: func(cpu *CPU) { cpu.csr[cycle] -= 8 }}
+	csrs[instret] = csrDesc{rmask: all, update: func(cpu *CPU) { cpu.csr[instret]-- }}
+
+	// mhpmcounter3-31 and mhpmevent3-31 are hardwired to zero, as no event is counted.
+	for i := uint64(0); i < 29; i++ {
+		csrs[mhpmcounter3+i] = csrDesc{rmask: all}
+		csrs[mhpmevent3+i] = csrDesc{rmask: all}
+	}
+}
+
+func legalizeMstatus(old, val uint64) uint64 {
+	// MPP = 0b10 is reserved, keep the old one.
+	if bits(val, 12, 11) == 0b10 {
+		val = val&^0x1800 | old&0x1800
+	}
+
+	val |= mstatusxl
+
+	// SD is read-only and summarizes whether FS or XS is Dirty.
+	val &^= 1 << 63
+	if bits(val, 14, 13) == 3 || bits(val, 16, 15) == 3 {
+		val |= 1 << 63
+	}
+
+	return val
+}
+
+// legalizeSatp ignores the write if the MODE is not supported.
+func legalizeSatp(old, val uint64) uint64 {
+	switch val >> 60 {
+	case 0, 8, 9, 10: // Bare, Sv39, Sv48, Sv57
+		return val
+	}
+
+	return old
+}
+
+func legalizeTvec(old, val uint64) uint64 {
+	// MODE >= 2 is reserved, keep the old one.
+	if val&0x3 >= 2 {
+		val = val&^0x3 | old&0x3
+	}
+
+	return val
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestWARL(t *testing.T) {
+	const sd = 1 << 63
+
+	tests := []struct {
+		name  string
+		reg   uint64 // the register initialized to old, and read after the write
+		old   uint64
+		addr  uint64 // the CSR written
+		value uint64
+		want  uint64
+	}{
+		{"mstatus MPP=2 keeps old", mstatus, mstatusxl | 3<<11, mstatus, 2 << 11, mstatusxl | 3<<11},
+		{"mstatus MPP=1", mstatus, mstatusxl | 3<<11, mstatus, 1 << 11, mstatusxl | 1<<11},
+		{"mstatus UXL and SXL are fixed", mstatus, mstatusxl, mstatus, 0, mstatusxl},
+		{"mstatus SD is read-only", mstatus, mstatusxl, mstatus, sd, mstatusxl},
+		{"mstatus FS dirty sets SD", mstatus, mstatusxl, mstatus, 3 << 13, sd | mstatusxl | 3<<13},
+		{"mstatus FS clean clears SD", mstatus, sd | mstatusxl | 3<<13, mstatus, 1 << 13, mstatusxl | 1<<13},
+		{"sstatus FS dirty sets SD", mstatus, mstatusxl, sstatus, 3 << 13, sd | mstatusxl | 3<<13},
+		{"sstatus doesn't write MPP", mstatus, mstatusxl, sstatus, 3 << 11, mstatusxl},
+		{"mtvec mode 2 keeps old", mtvec, 0x80000001, mtvec, 0x80001002, 0x80001001},
+		{"mtvec mode 3 keeps old", mtvec, 0x80000000, mtvec, 0x80001003, 0x80001000},
+		{"mtvec vectored", mtvec, 0x80000000, mtvec, 0x80001001, 0x80001001},
+		{"stvec mode 2 keeps old", stvec, 0x80000000, stvec, 0x80001002, 0x80001000},
+		{"satp Sv32 is ignored", satp, 8<<60 | 0x80000, satp, 1<<60 | 0x1234, 8<<60 | 0x80000},
+		{"satp reserved mode is ignored", satp, 8<<60 | 0x80000, satp, 5<<60 | 0x1234, 8<<60 | 0x80000},
+		{"satp Sv48", satp, 0, satp, 9<<60 | 0x1234, 9<<60 | 0x1234},
+		{"satp Bare", satp, 8<<60 | 0x80000, satp, 0, 0},
+		{"misa is not writable", misa, misaval, misa, 0, misaval},
+		{"medeleg", medeleg, 0, medeleg, all, medelegmask},
+		{"mideleg", mideleg, 0, mideleg, all, siemask},
+		{"mie", mie, 0, mie, all, mipmask},
+		{"sie", mie, 0, sie, all, siemask},
+		{"mip", mip, 0, mip, all, siemask},
+		{"sip writes only SSIP", mip, 0, sip, all, 0x2},
+		{"mepc is aligned", mepc, 0, mepc, 0x80000003, 0x80000002},
+		{"mcounteren is 32-bit", mcounteren, 0, mcounteren, all, 0xffffffff},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.csr[tc.reg] = tc.old
+			cpu.wcsr(tc.addr, tc.value)
+			if got := cpu.csr[tc.reg]; got != tc.want {
+				t.Fatalf("want %#x, got %#x", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMachineCounters(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	for i, inst := range []uint64{
+		0x06400513, // li a0, 100
+		0xb0251073, // csrw minstret, a0
+		0xb02025f3, // csrr a1, minstret
+		0xc0202673, // csrr a2, instret
+		0xb0051073, // csrw mcycle, a0
+		0xb00026f3, // csrr a3, mcycle
+		0xc0002773, // csrr a4, cycle
+		0xb0351073, // csrw mhpmcounter3, a0
+		0xb1f027f3, // csrr a5, mhpmcounter31
+		0x32351073, // csrw mhpmevent3, a0
+		0x33f02873, // csrr a6, mhpmevent31
+		0x32051073, // csrw mcountinhibit, a0
+		0x320028f3, // csrr a7, mcountinhibit
+	} {
+		cpu.ram.Write(drambase+uint64(i)*4, inst, word)
+	}
+	cpu.pc = drambase
+
+	for i := 0; i < 13; i++ {
+		if err := cpu.tick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.csr[mcause] != 0 {
+		t.Fatalf("unexpected trap: mcause %d, mepc %#x", cpu.csr[mcause], cpu.csr[mepc])
+	}
+
+	// a0 = x10, ..., a7 = x17
+	want := []uint64{100, 100, 101, 100, 108, 0, 0, 0}
+	for i, w := range want {
+		if got := cpu.xregs[10+i]; got != w {
+			t.Errorf("a%d: want %d, got %d", i, w, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Flattened device tree (DTB) describing the machine.
+// https://devicetree-specification.readthedocs.io/en/stable/flattened-format.html
+const (
+	fdtMagic     = 0xd00dfeed
+	fdtBeginNode = 0x1
+	fdtEndNode   = 0x2
+	fdtProp      = 0x3
+	fdtEnd       = 0x9
+
+	fdtHeaderSize = 40
+
+	// mtime is incremented on each CPU tick, that is once per instruction (or per idle step in wfi),
+	// rather than following the host clock. The guest time runs at this rate only when 10M
+	// instructions are executed per second.
+	timebaseFrequency = 10_000_000
+
+	// phandles
+	phandleCPUIntc  = 1
+	phandlePlic     = 2
+	phandleFinisher = 3
+)
+
+// fdt builds a DTB blob.
+type fdt struct {
+	structs bytes.Buffer
+	strings bytes.Buffer
+	stroffs map[string]uint32
+}
+
+func newFDT() *fdt {
+	return &fdt{stroffs: map[string]uint32{}}
+}
+
+func (f *fdt) u32(v uint32) {
+	binary.Write(&f.structs, binary.BigEndian, v)
+}
+
+// pad aligns the struct block to 4 bytes.
+func (f *fdt) pad() {
+	for f.structs.Len()%4 != 0 {
+		f.structs.WriteByte(0)
+	}
+}
+
+func (f *fdt) beginNode(name string) {
+	f.u32(fdtBeginNode)
+	f.structs.WriteString(name)
+	f.structs.WriteByte(0)
+	f.pad()
+}
+
+func (f *fdt) endNode() {
+	f.u32(fdtEndNode)
+}
+
+func (f *fdt) prop(name string, value []byte) {
+	off, ok := f.stroffs[name]
+	if !ok {
+		off = uint32(f.strings.Len())
+		f.stroffs[name] = off
+		f.strings.WriteString(name)
+		f.strings.WriteByte(0)
+	}
+
+	f.u32(fdtProp)
+	f.u32(uint32(len(value)))
+	f.u32(off)
+	f.structs.Write(value)
+	f.pad()
+}
+
+func (f *fdt) propEmpty(name string) {
+	f.prop(name, nil)
+}
+
+func (f *fdt) propU32(name string, values ...uint32) {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	f.prop(name, b)
+}
+
+// propU64 writes the values as pairs of cells, used for reg with #address-cells = #size-cells = 2.
+func (f *fdt) propU64(name string, values ...uint64) {
+	b := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(b[8*i:], v)
+	}
+	f.prop(name, b)
+}
+
+// propString writes a string or a string list.
+func (f *fdt) propString(name string, values ...string) {
+	var b []byte
+	for _, v := range values {
+		b = append(b, v...)
+		b = append(b, 0)
+	}
+	f.prop(name, b)
+}
+
+func (f *fdt) finish() []byte {
+	f.u32(fdtEnd)
+
+	// header, memory reservation block (only the terminator), structure block, strings block
+	rsvmapOff := uint32(fdtHeaderSize)
+	structOff := rsvmapOff + 16
+	stringsOff := structOff + uint32(f.structs.Len())
+	total := stringsOff + uint32(f.strings.Len())
+
+	var b bytes.Buffer
+	for _, v := range []uint32{
+		fdtMagic,
+		total,
+		structOff,
+		stringsOff,
+		rsvmapOff,
+		17, // version
+		16, // last compatible version
+		0,  // boot cpu
+		uint32(f.strings.Len()),
+		uint32(f.structs.Len()),
+	} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	b.Write(make([]byte, 16))
+	b.Write(f.structs.Bytes())
+	b.Write(f.strings.Bytes())
+
+	return b.Bytes()
+}
+
+// makeDTB generates the DTB describing the machine.
+func makeDTB(ramSize uint64, bootargs string) []byte {
+	f := newFDT()
+
+	f.beginNode("")
+	f.propU32("#address-cells", 2)
+	f.propU32("#size-cells", 2)
+	f.propString("compatible", "riscv-virtio")
+	f.propString("model", "rv")
+
+	f.beginNode("chosen")
+	f.propString("bootargs", bootargs)
+	f.propString("stdout-path", fmt.Sprintf("/soc/serial@%x", uartBase))
+	f.endNode()
+
+	f.beginNode(fmt.Sprintf("memory@%x", drambase))
+	f.propString("device_type", "memory")
+	f.propU64("reg", drambase, ramSize)
+	f.endNode()
+
+	f.beginNode("cpus")
+	f.propU32("#address-cells", 1)
+	f.propU32("#size-cells", 0)
+	f.propU32("timebase-frequency", timebaseFrequency)
+
+	f.beginNode("cpu@0")
+	f.propString("device_type", "cpu")
+	f.propU32("reg", 0)
+	f.propString("status", "okay")
+	f.propString("compatible", "riscv")
+	f.propString("riscv,isa", "rv64imafdc_zicsr_zifencei")
+	f.propString("riscv,isa-base", "rv64i")
+	f.propString("riscv,isa-extensions", "i", "m", "a", "f", "d", "c", "zicsr", "zifencei")
+	f.propString("mmu-type", "riscv,sv57")
+
+	f.beginNode("interrupt-controller")
+	f.propU32("#interrupt-cells", 1)
+	f.propEmpty("interrupt-controller")
+	f.propString("compatible", "riscv,cpu-intc")
+	f.propU32("phandle", phandleCPUIntc)
+	f.endNode()
+
+	f.endNode() // cpu@0
+	f.endNode() // cpus
+
+	f.beginNode("soc")
+	f.propU32("#address-cells", 2)
+	f.propU32("#size-cells", 2)
+	f.propString("compatible", "simple-bus")
+	f.propEmpty("ranges")
+
+	f.beginNode(fmt.Sprintf("clint@%x", clintBase))
+	f.propString("compatible", "sifive,clint0", "riscv,clint0")
+	f.propU64("reg", clintBase, clintSize)
+	f.propU32("interrupts-extended", phandleCPUIntc, machineSoftwareIntr, phandleCPUIntc, machineTimerIntr)
+	f.endNode()
+
+	f.beginNode(fmt.Sprintf("plic@%x", plicBase))
+	f.propString("compatible", "sifive,plic-1.0.0", "riscv,plic0")
+	f.propU64("reg", plicBase, plicSize)
+	f.propU32("#address-cells", 0)
+	f.propU32("#interrupt-cells", 1)
+	f.propEmpty("interrupt-controller")
+	f.propU32("interrupts-extended", phandleCPUIntc, machineExternalIntr, phandleCPUIntc, supervisorExternalIntr)
+	f.propU32("riscv,ndev", plicSources-1)
+	f.propU32("phandle", phandlePlic)
+	f.endNode()
+
+	f.beginNode(fmt.Sprintf("serial@%x", uartBase))
+	f.propString("compatible", "ns16550a")
+	f.propU64("reg", uartBase, uartSize)
+	f.propU32("clock-frequency", 3686400)
+	f.propU32("interrupt-parent", phandlePlic)
+	f.propU32("interrupts", uartIrq)
+	f.endNode()
+
+	f.beginNode(fmt.Sprintf("virtio_mmio@%x", virtioBase))
+	f.propString("compatible", "virtio,mmio")
+	f.propU64("reg", virtioBase, virtioSize)
+	f.propU32("interrupt-parent", phandlePlic)
+	f.propU32("interrupts", virtioIrq)
+	f.endNode()
+
+	f.beginNode(fmt.Sprintf("test@%x", finisherBase))
+	f.propString("compatible", "sifive,test1", "sifive,test0", "syscon")
+	f.propU64("reg", finisherBase, finisherSize)
+	f.propU32("phandle", phandleFinisher)
+	f.endNode()
+
+	f.endNode() // soc
+
+	f.beginNode("poweroff")
+	f.propString("compatible", "syscon-poweroff")
+	f.propU32("regmap", phandleFinisher)
+	f.propU32("offset", 0)
+	f.propU32("value", finisherPass)
+	f.endNode()
+
+	f.beginNode("reboot")
+	f.propString("compatible", "syscon-reboot")
+	f.propU32("regmap", phandleFinisher)
+	f.propU32("offset", 0)
+	f.propU32("value", finisherReset)
+	f.endNode()
+
+	f.endNode() // root
+
+	return f.finish()
+}
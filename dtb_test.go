@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dtNode is a node parsed from the structure block.
+type dtNode struct {
+	props    map[string][]byte
+	children map[string]*dtNode
+}
+
+// parseDTB walks the structure block and returns the root node.
+func parseDTB(t *testing.T, dtb []byte) *dtNode {
+	t.Helper()
+	be := binary.BigEndian
+	structOff, stringsOff := be.Uint32(dtb[8:]), be.Uint32(dtb[12:])
+	structSize := be.Uint32(dtb[36:])
+	strs := dtb[stringsOff:]
+	cstr := func(b []byte) string {
+		return string(b[:bytes.IndexByte(b, 0)])
+	}
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+
+	var root *dtNode
+	var stack []*dtNode
+	for off := structOff; ; {
+		if off >= structOff+structSize {
+			t.Fatalf("FDT_END is not found")
+		}
+		token := be.Uint32(dtb[off:])
+		off += 4
+
+		switch token {
+		case fdtBeginNode:
+			name := cstr(dtb[off:])
+			off += align(uint32(len(name)) + 1)
+			n := &dtNode{props: map[string][]byte{}, children: map[string]*dtNode{}}
+			if len(stack) == 0 {
+				if root != nil {
+					t.Fatalf("multiple root nodes")
+				}
+				root = n
+			} else {
+				parent := stack[len(stack)-1]
+				if _, ok := parent.children[name]; ok {
+					t.Fatalf("duplicated node %q", name)
+				}
+				parent.children[name] = n
+			}
+			stack = append(stack, n)
+
+		case fdtProp:
+			if len(stack) == 0 {
+				t.Fatalf("property outside of the nodes at %#x", off)
+			}
+			size, nameoff := be.Uint32(dtb[off:]), be.Uint32(dtb[off+4:])
+			off += 8
+			stack[len(stack)-1].props[cstr(strs[nameoff:])] = dtb[off : off+size]
+			off += align(size)
+
+		case fdtEndNode:
+			if len(stack) == 0 {
+				t.Fatalf("unbalanced FDT_END_NODE at %#x", off)
+			}
+			stack = stack[:len(stack)-1]
+
+		case fdtEnd:
+			if len(stack) != 0 || root == nil {
+				t.Fatalf("FDT_END in a node")
+			}
+			return root
+
+		default:
+			t.Fatalf("unknown token %#x at %#x", token, off-4)
+		}
+	}
+}
+
+// node returns the node at the path such as "/soc/plic@c000000". The unit address may be omitted.
+func (n *dtNode) node(t *testing.T, path string) *dtNode {
+	t.Helper()
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		c, ok := n.children[name]
+		for child, cn := range n.children {
+			if !ok && strings.HasPrefix(child, name+"@") {
+				c, ok = cn, true
+			}
+		}
+		if !ok {
+			t.Fatalf("node %s is not found", path)
+		}
+		n = c
+	}
+	return n
+}
+
+func (n *dtNode) u32s(t *testing.T, prop string) []uint32 {
+	t.Helper()
+	b, ok := n.props[prop]
+	if !ok || len(b)%4 != 0 {
+		t.Fatalf("property %s is not found or malformed: %x", prop, b)
+	}
+	v := make([]uint32, len(b)/4)
+	for i := range v {
+		v[i] = binary.BigEndian.Uint32(b[4*i:])
+	}
+	return v
+}
+
+func (n *dtNode) u64s(t *testing.T, prop string) []uint64 {
+	t.Helper()
+	cells := n.u32s(t, prop)
+	v := make([]uint64, len(cells)/2)
+	for i := range v {
+		v[i] = uint64(cells[2*i])<<32 | uint64(cells[2*i+1])
+	}
+	return v
+}
+
+func TestDTB(t *testing.T) {
+	dtb := makeDTB(defaultRAMSize, "console=ttyS0")
+
+	if got := binary.BigEndian.Uint32(dtb[0:]); got != fdtMagic {
+		t.Fatalf("magic: %#x", got)
+	}
+	if got := binary.BigEndian.Uint32(dtb[4:]); got != uint32(len(dtb)) {
+		t.Fatalf("totalsize: want %d, got %d", len(dtb), got)
+	}
+	if !bytes.Contains(dtb, []byte("console=ttyS0\x00")) {
+		t.Fatalf("bootargs is not found")
+	}
+
+	cpu := NewCPU(defaultRAMSize)
+	if err := cpu.loadDTB(dtb); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.rxreg(11) != dtbbase {
+		t.Fatalf("a1: want %#x, got %#x", dtbbase, cpu.rxreg(11))
+	}
+	if got, _ := cpu.readRaw(dtbbase, word); got != 0xedfe0dd0 {
+		t.Fatalf("dtb is not mapped: %#x", got)
+	}
+}
+
+func TestDTBStructure(t *testing.T) {
+	root := parseDTB(t, makeDTB(defaultRAMSize, "console=ttyS0"))
+
+	if got := root.node(t, "chosen").props["bootargs"]; string(got) != "console=ttyS0\x00" {
+		t.Errorf("bootargs: %q", got)
+	}
+	if got := root.node(t, "memory").u64s(t, "reg"); !reflect.DeepEqual(got, []uint64{drambase, defaultRAMSize}) {
+		t.Errorf("memory reg: %#x", got)
+	}
+	if got := root.node(t, "cpus").u32s(t, "timebase-frequency"); got[0] != timebaseFrequency {
+		t.Errorf("timebase-frequency: %d", got[0])
+	}
+
+	intc := root.node(t, "cpus/cpu@0/interrupt-controller")
+	if _, ok := intc.props["interrupt-controller"]; !ok {
+		t.Errorf("cpu interrupt-controller is not an interrupt controller")
+	}
+	if got := intc.u32s(t, "phandle"); got[0] != phandleCPUIntc {
+		t.Errorf("cpu intc phandle: %d", got[0])
+	}
+
+	plic := root.node(t, "soc/plic")
+	if got := plic.u32s(t, "phandle"); got[0] != phandlePlic {
+		t.Errorf("plic phandle: %d", got[0])
+	}
+
+	tests := []struct {
+		path      string
+		reg       []uint64
+		prop      string // interrupts-extended or interrupts
+		intr      []uint32
+		intParent uint32
+	}{
+		{"soc/clint", []uint64{clintBase, clintSize}, "interrupts-extended", []uint32{phandleCPUIntc, machineSoftwareIntr, phandleCPUIntc, machineTimerIntr}, 0},
+		{"soc/plic", []uint64{plicBase, plicSize}, "interrupts-extended", []uint32{phandleCPUIntc, machineExternalIntr, phandleCPUIntc, supervisorExternalIntr}, 0},
+		{"soc/serial", []uint64{uartBase, uartSize}, "interrupts", []uint32{uartIrq}, phandlePlic},
+		{"soc/virtio_mmio", []uint64{virtioBase, virtioSize}, "interrupts", []uint32{virtioIrq}, phandlePlic},
+		{"soc/test", []uint64{finisherBase, finisherSize}, "", nil, 0},
+	}
+
+	for _, tc := range tests {
+		n := root.node(t, tc.path)
+		if got := n.u64s(t, "reg"); !reflect.DeepEqual(got, tc.reg) {
+			t.Errorf("%s reg: want %#x, got %#x", tc.path, tc.reg, got)
+		}
+		if tc.prop != "" {
+			if got := n.u32s(t, tc.prop); !reflect.DeepEqual(got, tc.intr) {
+				t.Errorf("%s %s: want %d, got %d", tc.path, tc.prop, tc.intr, got)
+			}
+		}
+		if tc.intParent != 0 {
+			if got := n.u32s(t, "interrupt-parent"); got[0] != tc.intParent {
+				t.Errorf("%s interrupt-parent: want %d, got %d", tc.path, tc.intParent, got[0])
+			}
+		}
+	}
+	// unit addresses are the base addresses in reg
+	for _, parent := range []*dtNode{root, root.node(t, "soc")} {
+		for name, n := range parent.children {
+			_, unit, ok := strings.Cut(name, "@")
+			if !ok {
+				continue
+			}
+			if want := fmt.Sprintf("%x", n.u64s(t, "reg")[0]); unit != want {
+				t.Errorf("%s: want unit address %s, got %s", name, want, unit)
+			}
+		}
+	}
+
+	stdout := strings.TrimSuffix(string(root.node(t, "chosen").props["stdout-path"]), "\x00")
+	if got := root.node(t, stdout).u64s(t, "reg"); got[0] != uartBase {
+		t.Errorf("stdout-path %s is not the UART: %#x", stdout, got)
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"os"
 	"path/filepath"
-	"runtime"
 	"testing"
 )
 
 // TestE2E runs riscv-tests (https://github.com/riscv-software-src/riscv-tests) and make sure
 // every test suite passes.
 // Before running this test, test binary must locate in "./tests/" directory.
+// The binaries for F, D and C extensions are built by "make riscv-tests".
 func TestE2E(t *testing.T) {
 	tests := []string{
 		"rv64ui-p-add",
@@ -100,6 +101,33 @@ func TestE2E(t *testing.T) {
 		"rv64um-p-remuw",
 		"rv64um-p-remw",
 
+		"rv64uf-p-fadd",
+		"rv64uf-p-fclass",
+		"rv64uf-p-fcmp",
+		"rv64uf-p-fcvt",
+		"rv64uf-p-fcvt_w",
+		"rv64uf-p-fdiv",
+		"rv64uf-p-fmadd",
+		"rv64uf-p-fmin",
+		"rv64uf-p-ldst",
+		"rv64uf-p-move",
+		"rv64uf-p-recoding",
+
+		"rv64ud-p-fadd",
+		"rv64ud-p-fclass",
+		"rv64ud-p-fcmp",
+		"rv64ud-p-fcvt",
+		"rv64ud-p-fcvt_w",
+		"rv64ud-p-fdiv",
+		"rv64ud-p-fmadd",
+		"rv64ud-p-fmin",
+		"rv64ud-p-ldst",
+		"rv64ud-p-move",
+		"rv64ud-p-recoding",
+		"rv64ud-p-structural",
+
+		"rv64uc-p-rvc",
+
 		"rv64ui-v-add",
 		"rv64ui-v-addi",
 		"rv64ui-v-addiw",
@@ -126,9 +154,9 @@ func TestE2E(t *testing.T) {
 		"rv64ui-v-lwu",
 		"rv64ui-v-or",
 		"rv64ui-v-ori",
-		//"rv64ui-v-sb",
-		//"rv64ui-v-sd",
-		//"rv64ui-v-sh",
+		"rv64ui-v-sb",
+		"rv64ui-v-sd",
+		"rv64ui-v-sh",
 		"rv64ui-v-simple",
 		"rv64ui-v-sll",
 		"rv64ui-v-slli",
@@ -148,14 +176,46 @@ func TestE2E(t *testing.T) {
 		"rv64ui-v-srlw",
 		"rv64ui-v-sub",
 		"rv64ui-v-subw",
-		//"rv64ui-v-sw",
+		"rv64ui-v-sw",
 		"rv64ui-v-xor",
 		"rv64ui-v-xori",
+
+		"rv64uf-v-fadd",
+		"rv64uf-v-fclass",
+		"rv64uf-v-fcmp",
+		"rv64uf-v-fcvt",
+		"rv64uf-v-fcvt_w",
+		"rv64uf-v-fdiv",
+		"rv64uf-v-fmadd",
+		"rv64uf-v-fmin",
+		"rv64uf-v-ldst",
+		"rv64uf-v-move",
+		"rv64uf-v-recoding",
+
+		"rv64ud-v-fadd",
+		"rv64ud-v-fclass",
+		"rv64ud-v-fcmp",
+		"rv64ud-v-fcvt",
+		"rv64ud-v-fcvt_w",
+		"rv64ud-v-fdiv",
+		"rv64ud-v-fmadd",
+		"rv64ud-v-fmin",
+		"rv64ud-v-ldst",
+		"rv64ud-v-move",
+		"rv64ud-v-recoding",
+		"rv64ud-v-structural",
+
+		"rv64uc-v-rvc",
 	}
 
 	for _, tc := range tests {
 		t.Run(tc, func(t *testing.T) {
-			cpu, err := initCPU(filepath.Join("./tests/", tc))
+			file := filepath.Join("./tests/", tc)
+			if _, err := os.Stat(file); err != nil {
+				t.Fatalf("test binary is not found: %s", err)
+			}
+
+			cpu, err := initCPU(file, defaultRAMSize)
 			if err != nil {
 				t.Fatalf("initialize RV: %s, %s", tc, err)
 			}
@@ -169,11 +229,5 @@ func TestE2E(t *testing.T) {
 			}
 
 		})
-
-		// Each test runs rv emulator which internally contains 4GiB space for DRAM emulation.
-		// Because GitHub Actions single hosted runner only has 7GB memory,
-		// sometimes the test is killed by OOM without this manual GC.
-		// TODO: optimize somehow
-		runtime.GC()
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+// SiFive test finisher, which Linux and OpenSBI use to power off and reboot the machine.
+// Writing a command to the register requests the host to stop or reset the machine.
+// The upper 16 bits are the exit code for the fail command.
+const (
+	finisherBase = 0x10_0000
+	finisherSize = 0x1000
+
+	finisherFail  = 0x3333
+	finisherPass  = 0x5555
+	finisherReset = 0x7777
+)
+
+type Finisher struct {
+	requested bool
+	reboot    bool
+	code      uint64
+}
+
+func NewFinisher() *Finisher {
+	return &Finisher{}
+}
+
+func (f *Finisher) read(offset uint64, size int) (uint64, bool) {
+	return 0, true
+}
+
+func (f *Finisher) write(offset, val uint64, size int) bool {
+	if offset != 0 || size != word {
+		return false
+	}
+
+	switch val & 0xffff {
+	case finisherPass:
+		*f = Finisher{requested: true}
+	case finisherFail:
+		code := (val >> 16) & 0xffff
+		if code == 0 {
+			// fail never means success.
+			code = 1
+		}
+		*f = Finisher{requested: true, code: code}
+	case finisherReset:
+		*f = Finisher{requested: true, reboot: true}
+	}
+
+	return true
+}
+
+func (f *Finisher) tick() {}
+
+func (f *Finisher) reset() {
+	*f = Finisher{}
+}
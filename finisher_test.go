@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFinisher(t *testing.T) {
+	tests := []struct {
+		val       uint64
+		requested bool
+		reboot    bool
+		code      uint64
+	}{
+		{finisherPass, true, false, 0},
+		{5<<16 | finisherFail, true, false, 5},
+		{finisherFail, true, false, 1},
+		{finisherReset, true, true, 0},
+		{0x1234, false, false, 0},
+	}
+
+	for _, tc := range tests {
+		f := NewFinisher()
+		if !f.write(0, tc.val, word) {
+			t.Fatalf("%#x: write failed", tc.val)
+		}
+		if f.requested != tc.requested || f.reboot != tc.reboot || f.code != tc.code {
+			t.Errorf("%#x: want %t %t %d, got %t %t %d", tc.val, tc.requested, tc.reboot, tc.code, f.requested, f.reboot, f.code)
+		}
+	}
+}
+
+func TestFinisherReset(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	for i, inst := range []uint64{
+		0x00001297, // auipc t0, 1
+		0x0002b303, // ld t1, 0(t0)
+		0x02031063, // bnez t1, 1f
+		0x00100313, // li t1, 1
+		0x0062b023, // sd t1, 0(t0)
+		0x001003b7, // lui t2, 0x100
+		0x00007e37, // lui t3, 0x7
+		0x777e0e13, // addi t3, t3, 0x777
+		0x01c3a023, // sw t3, 0(t2)
+		0x0000006f, // j .
+		0x001003b7, // 1: lui t2, 0x100
+		0x00053e37, // lui t3, 0x53
+		0x333e0e13, // addi t3, t3, 0x333
+		0x01c3a023, // sw t3, 0(t2)
+		0x0000006f, // j .
+	} {
+		cpu.ram.Write(drambase+uint64(i)*4, inst, word)
+	}
+	cpu.pc = drambase
+	cpu.csr[mscratch] = 1
+
+	// the memory is kept across the reset, so the program fails with the code 5 after the reboot.
+	r := &RV{cpu: cpu, entry: drambase}
+	err := r.Start()
+
+	var ee *exitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("want exitError, got %v", err)
+	}
+	if ee.exitCode() != 5 || r.exit.cause != "test finisher" {
+		t.Fatalf("want code 5 by test finisher, got %d by %s", ee.exitCode(), r.exit.cause)
+	}
+	if cpu.csr[mscratch] != 0 {
+		t.Fatalf("mscratch is not reset: %#x", cpu.csr[mscratch])
+	}
+	if got := cpu.csr[instret]; got != 7 {
+		t.Fatalf("instret after reset: want 7, got %d", got)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"math"
+	"math/big"
+)
+
+const (
+	// rounding mode
+	rne = 0 // round to nearest, ties to even
+	rtz = 1 // round towards zero
+	rdn = 2 // round down (towards -inf)
+	rup = 3 // round up (towards +inf)
+	rmm = 4 // round to nearest, ties to max magnitude
+	dyn = 7 // use frm
+
+	// accrued exceptions in fflags
+	fflagNX = 0x01 // inexact
+	fflagUF = 0x02 // underflow
+	fflagOF = 0x04 // overflow
+	fflagDZ = 0x08 // divide by zero
+	fflagNV = 0x10 // invalid operation
+)
+
+// fpFormat is an IEEE 754 binary floating-point format.
+// Every value is handled as its raw bits, a single-precision value lives in the lower 32 bits.
+type fpFormat struct {
+	expBits  int
+	fracBits int
+}
+
+var (
+	single = fpFormat{expBits: 8, fracBits: 23}
+	double = fpFormat{expBits: 11, fracBits: 52}
+)
+
+func (f fpFormat) bias() int {
+	return 1<<(f.expBits-1) - 1
+}
+
+func (f fpFormat) sign(x uint64) uint64 {
+	return (x >> (f.expBits + f.fracBits)) & 1
+}
+
+func (f fpFormat) exp(x uint64) uint64 {
+	return (x >> f.fracBits) & (1<<f.expBits - 1)
+}
+
+func (f fpFormat) frac(x uint64) uint64 {
+	return x & (1<<f.fracBits - 1)
+}
+
+func (f fpFormat) isNaN(x uint64) bool {
+	return f.exp(x) == 1<<f.expBits-1 && f.frac(x) != 0
+}
+
+// isSNaN returns true if x is a signaling NaN, whose most significant fraction bit is 0.
+func (f fpFormat) isSNaN(x uint64) bool {
+	return f.isNaN(x) && (f.frac(x)>>(f.fracBits-1))&1 == 0
+}
+
+func (f fpFormat) isInf(x uint64) bool {
+	return f.exp(x) == 1<<f.expBits-1 && f.frac(x) == 0
+}
+
+func (f fpFormat) isZero(x uint64) bool {
+	return f.exp(x) == 0 && f.frac(x) == 0
+}
+
+// qnan returns the canonical NaN. RISC-V does not propagate NaN payloads.
+func (f fpFormat) qnan() uint64 {
+	return (1<<f.expBits-1)<<f.fracBits | 1<<(f.fracBits-1)
+}
+
+func (f fpFormat) zero(sign uint64) uint64 {
+	return sign << (f.expBits + f.fracBits)
+}
+
+func (f fpFormat) inf(sign uint64) uint64 {
+	return f.zero(sign) | (1<<f.expBits-1)<<f.fracBits
+}
+
+func (f fpFormat) maxFinite(sign uint64) uint64 {
+	return f.zero(sign) | (1<<f.expBits-2)<<f.fracBits | (1<<f.fracBits - 1)
+}
+
+func (f fpFormat) neg(x uint64) uint64 {
+	return x ^ f.zero(1)
+}
+
+// float64 returns x as float64. The conversion is exact for both formats.
+func (f fpFormat) float64(x uint64) float64 {
+	if f == single {
+		return float64(math.Float32frombits(uint32(x)))
+	}
+
+	return math.Float64frombits(x)
+}
+
+// big returns the finite value x as big.Float.
+func (f fpFormat) big(x uint64) *big.Float {
+	return new(big.Float).SetPrec(64).SetFloat64(f.float64(x))
+}
+
+// trunc returns a big.Float to store an intermediate result.
+// The result is truncated into 64 bits and the lost bits are reported by its accuracy,
+// which is enough to round it again into the 24 or 53 bits of the actual format.
+func trunc() *big.Float {
+	return new(big.Float).SetPrec(64).SetMode(big.ToZero)
+}
+
+// roundBits shifts u right by shift bits and rounds the result according to rm.
+// sticky tells if there are non-zero bits below u. It returns the rounded value and
+// whether the result is inexact.
+func roundBits(u uint64, shift int, sticky bool, sign, rm uint64) (uint64, bool) {
+	if shift > 64 {
+		sticky = sticky || u != 0
+		u = 0
+		shift = 64
+	}
+
+	q := u >> shift
+	rem := u & (1<<shift - 1)
+	half := uint64(1) << (shift - 1)
+	inexact := rem != 0 || sticky
+
+	inc := false
+	switch rm {
+	case rne:
+		inc = rem > half || (rem == half && (sticky || q&1 == 1))
+	case rmm:
+		inc = rem >= half
+	case rdn:
+		inc = inexact && sign == 1
+	case rup:
+		inc = inexact && sign == 0
+	}
+
+	if inc {
+		q++
+	}
+
+	return q, inexact
+}
+
+// round rounds the non-zero finite value z, which is computed by trunc(), into f.
+func (f fpFormat) round(z *big.Float, rm uint64) (uint64, uint64) {
+	sign := uint64(0)
+	if z.Signbit() {
+		sign = 1
+	}
+	sticky := z.Acc() != big.Exact
+
+	// |z| = u * 2^(e-63), where the most significant bit of u is set.
+	var m big.Float
+	e := z.MantExp(&m) - 1
+	m.SetMantExp(&m, 64)
+	m.Abs(&m)
+	u, _ := m.Uint64()
+
+	p := f.fracBits + 1
+	emin := 1 - f.bias()
+	emax := f.bias()
+
+	// RISC-V detects tininess after rounding, as if the exponent range were unbounded.
+	q, _ := roundBits(u, 64-p, sticky, sign, rm)
+	tiny := e+int(q>>p) < emin
+
+	shift := 64 - p
+	if e < emin {
+		shift += emin - e
+	}
+
+	q, inexact := roundBits(u, shift, sticky, sign, rm)
+
+	var fl uint64
+	if inexact {
+		fl |= fflagNX
+		if tiny {
+			fl |= fflagUF
+		}
+	}
+
+	if e < emin {
+		// subnormal. If the rounding carries, q reaches the exponent field
+		// and the result becomes the smallest normal number.
+		return f.zero(sign) | q, fl
+	}
+
+	if q>>p != 0 {
+		q >>= 1
+		e++
+	}
+
+	if e > emax {
+		fl |= fflagOF | fflagNX
+		if rm == rtz || (rm == rdn && sign == 0) || (rm == rup && sign == 1) {
+			return f.maxFinite(sign), fl
+		}
+		return f.inf(sign), fl
+	}
+
+	return f.zero(sign) | uint64(e+f.bias())<<f.fracBits | f.frac(q), fl
+}
+
+// nanResult returns the canonical NaN if any of the operands is NaN.
+// The third value reports whether NaN is found.
+func (f fpFormat) nanResult(xs ...uint64) (uint64, uint64, bool) {
+	found := false
+	var fl uint64
+	for _, x := range xs {
+		if f.isSNaN(x) {
+			fl |= fflagNV
+		}
+		if f.isNaN(x) {
+			found = true
+		}
+	}
+
+	return f.qnan(), fl, found
+}
+
+// exactZero returns the sign of an exact zero sum of the values whose signs are sa and sb.
+func exactZero(sa, sb, rm uint64) uint64 {
+	if sa == sb {
+		return sa
+	}
+
+	if rm == rdn {
+		return 1
+	}
+
+	return 0
+}
+
+func (f fpFormat) add(a, b, rm uint64) (uint64, uint64) {
+	if v, fl, ok := f.nanResult(a, b); ok {
+		return v, fl
+	}
+
+	sa, sb := f.sign(a), f.sign(b)
+	switch {
+	case f.isInf(a) && f.isInf(b):
+		if sa != sb {
+			return f.qnan(), fflagNV
+		}
+		return a, 0
+	case f.isInf(a):
+		return a, 0
+	case f.isInf(b):
+		return b, 0
+	}
+
+	z := trunc().Add(f.big(a), f.big(b))
+	if z.Sign() == 0 {
+		return f.zero(exactZero(sa, sb, rm)), 0
+	}
+
+	return f.round(z, rm)
+}
+
+func (f fpFormat) sub(a, b, rm uint64) (uint64, uint64) {
+	if v, fl, ok := f.nanResult(a, b); ok {
+		return v, fl
+	}
+
+	return f.add(a, f.neg(b), rm)
+}
+
+func (f fpFormat) mul(a, b, rm uint64) (uint64, uint64) {
+	if v, fl, ok := f.nanResult(a, b); ok {
+		return v, fl
+	}
+
+	sign := f.sign(a) ^ f.sign(b)
+	switch {
+	case (f.isInf(a) && f.isZero(b)) || (f.isZero(a) && f.isInf(b)):
+		return f.qnan(), fflagNV
+	case f.isInf(a) || f.isInf(b):
+		return f.inf(sign), 0
+	case f.isZero(a) || f.isZero(b):
+		return f.zero(sign), 0
+	}
+
+	return f.round(trunc().Mul(f.big(a), f.big(b)), rm)
+}
+
+func (f fpFormat) div(a, b, rm uint64) (uint64, uint64) {
+	if v, fl, ok := f.nanResult(a, b); ok {
+		return v, fl
+	}
+
+	sign := f.sign(a) ^ f.sign(b)
+	switch {
+	case (f.isInf(a) && f.isInf(b)) || (f.isZero(a) && f.isZero(b)):
+		return f.qnan(), fflagNV
+	case f.isInf(a):
+		return f.inf(sign), 0
+	case f.isInf(b):
+		return f.zero(sign), 0
+	case f.isZero(b):
+		return f.inf(sign), fflagDZ
+	case f.isZero(a):
+		return f.zero(sign), 0
+	}
+
+	return f.round(trunc().Quo(f.big(a), f.big(b)), rm)
+}
+
+func (f fpFormat) sqrt(a, rm uint64) (uint64, uint64) {
+	if v, fl, ok := f.nanResult(a); ok {
+		return v, fl
+	}
+
+	switch {
+	case f.isZero(a):
+		return a, 0
+	case f.sign(a) == 1:
+		return f.qnan(), fflagNV
+	case f.isInf(a):
+		return a, 0
+	}
+
+	x := f.big(a)
+	z := trunc().Sqrt(x)
+
+	// big.Float does not compute the accuracy of Sqrt, so check it by squaring the result.
+	sq := new(big.Float).SetPrec(128)
+	ulp := new(big.Float).SetMantExp(big.NewFloat(1), z.MantExp(nil)-64)
+	if sq.Mul(z, z).Cmp(x) > 0 {
+		z.Sub(z, ulp)
+	} else if next := trunc().Add(z, ulp); sq.Mul(next, next).Cmp(x) <= 0 {
+		z = next
+	}
+
+	if sq.Mul(z, z).Cmp(x) == 0 {
+		return f.round(trunc().Set(z), rm)
+	}
+
+	// make the result inexact, the lost bits are below the 64 bits anyway.
+	return f.round(trunc().Add(z, ulp.SetMantExp(ulp, -2)), rm)
+}
+
+// fma computes (a * b) + c with a single rounding.
+// negProd and negC negate the product and the addend respectively to implement fmsub, fnmsub and fnmadd.
+func (f fpFormat) fma(a, b, c uint64, negProd, negC bool, rm uint64) (uint64, uint64) {
+	// the multiplication of infinity and zero is invalid even if c is a quiet NaN.
+	if (f.isInf(a) && f.isZero(b)) || (f.isZero(a) && f.isInf(b)) {
+		return f.qnan(), fflagNV
+	}
+
+	if v, fl, ok := f.nanResult(a, b, c); ok {
+		return v, fl
+	}
+
+	if negC {
+		c = f.neg(c)
+	}
+
+	sp := f.sign(a) ^ f.sign(b)
+	if negProd {
+		sp ^= 1
+	}
+	sc := f.sign(c)
+
+	switch {
+	case f.isInf(a) || f.isInf(b):
+		if f.isInf(c) && sc != sp {
+			return f.qnan(), fflagNV
+		}
+		return f.inf(sp), 0
+	case f.isInf(c):
+		return c, 0
+	case f.isZero(a) || f.isZero(b):
+		if f.isZero(c) {
+			return f.zero(exactZero(sp, sc, rm)), 0
+		}
+		return c, 0
+	}
+
+	// the product of 2 values fits in 128 bits, so this is exact.
+	prod := new(big.Float).SetPrec(128).Mul(f.big(a), f.big(b))
+	if negProd {
+		prod.Neg(prod)
+	}
+
+	z := trunc().Add(prod, f.big(c))
+	if z.Sign() == 0 {
+		return f.zero(exactZero(sp, sc, rm)), 0
+	}
+
+	return f.round(z, rm)
+}
+
+// convert converts a in the format f into the format to.
+func (f fpFormat) convert(to fpFormat, a, rm uint64) (uint64, uint64) {
+	if _, fl, ok := f.nanResult(a); ok {
+		return to.qnan(), fl
+	}
+
+	switch {
+	case f.isInf(a):
+		return to.inf(f.sign(a)), 0
+	case f.isZero(a):
+		return to.zero(f.sign(a)), 0
+	}
+
+	return to.round(trunc().Set(f.big(a)), rm)
+}
+
+// fromInt converts the integer v into f. If signed is true, v is interpreted as int64.
+func (f fpFormat) fromInt(v uint64, signed bool, rm uint64) (uint64, uint64) {
+	if v == 0 {
+		return f.zero(0), 0
+	}
+
+	z := trunc().SetUint64(v)
+	if signed && int64(v) < 0 {
+		z.SetUint64(-v)
+		z.Neg(z)
+	}
+
+	return f.round(z, rm)
+}
+
+// toInt converts a into the integer which has the given bit width.
+// The result is sign-extended into 64 bits even if it is unsigned.
+func (f fpFormat) toInt(a, rm uint64, width int, signed bool) (uint64, uint64) {
+	// the results for out of range values
+	var minInt, maxInt uint64
+	if signed {
+		minInt, maxInt = -(uint64(1) << (width - 1)), uint64(1)<<(width-1)-1
+	} else {
+		minInt, maxInt = 0, 1<<width-1
+	}
+
+	extend := func(v uint64) uint64 {
+		if width == 32 {
+			return uint64(int64(int32(v)))
+		}
+		return v
+	}
+
+	if f.isNaN(a) {
+		return extend(maxInt), fflagNV
+	}
+
+	v := f.float64(a)
+	var r float64
+	switch rm {
+	case rne:
+		r = math.RoundToEven(v)
+	case rtz:
+		r = math.Trunc(v)
+	case rdn:
+		r = math.Floor(v)
+	case rup:
+		r = math.Ceil(v)
+	case rmm:
+		r = math.Round(v)
+	}
+
+	lo, hi := 0.0, math.Ldexp(1, width)
+	if signed {
+		lo, hi = -math.Ldexp(1, width-1), math.Ldexp(1, width-1)
+	}
+
+	switch {
+	case r < lo:
+		return extend(minInt), fflagNV
+	case r >= hi:
+		return extend(maxInt), fflagNV
+	}
+
+	var fl uint64
+	if r != v {
+		fl = fflagNX
+	}
+
+	if signed {
+		return extend(uint64(int64(r))), fl
+	}
+
+	return extend(uint64(r)), fl
+}
+
+// cmp compares a and b. The result is meaningful only if neither of them is NaN.
+func (f fpFormat) cmp(a, b uint64) int {
+	va, vb := f.float64(a), f.float64(b)
+	switch {
+	case va < vb:
+		return -1
+	case va > vb:
+		return 1
+	}
+	return 0
+}
+
+// eq is a quiet comparison which raises the invalid operation only for signaling NaN.
+func (f fpFormat) eq(a, b uint64) (uint64, uint64) {
+	if _, fl, ok := f.nanResult(a, b); ok {
+		return 0, fl
+	}
+
+	if f.cmp(a, b) == 0 {
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// lt is a signaling comparison which raises the invalid operation for any NaN.
+func (f fpFormat) lt(a, b uint64) (uint64, uint64) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return 0, fflagNV
+	}
+
+	if f.cmp(a, b) < 0 {
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// le is a signaling comparison which raises the invalid operation for any NaN.
+func (f fpFormat) le(a, b uint64) (uint64, uint64) {
+	if f.isNaN(a) || f.isNaN(b) {
+		return 0, fflagNV
+	}
+
+	if f.cmp(a, b) <= 0 {
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// minmax returns the smaller of a and b if larger is false, otherwise the larger.
+// If only one of them is NaN, the other one is returned. -0 is considered smaller than +0.
+func (f fpFormat) minmax(a, b uint64, larger bool) (uint64, uint64) {
+	var fl uint64
+	if f.isSNaN(a) || f.isSNaN(b) {
+		fl = fflagNV
+	}
+
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.qnan(), fl
+	case f.isNaN(a):
+		return b, fl
+	case f.isNaN(b):
+		return a, fl
+	}
+
+	c := f.cmp(a, b)
+	if c == 0 {
+		// either of them might be -0
+		c = int(f.sign(b)) - int(f.sign(a))
+	}
+
+	if (c < 0) != larger {
+		return a, fl
+	}
+	return b, fl
+}
+
+// classify returns the 10-bit mask which fclass instructions write.
+func (f fpFormat) classify(a uint64) uint64 {
+	neg := f.sign(a) == 1
+	sub := f.exp(a) == 0 && f.frac(a) != 0
+	switch {
+	case f.isInf(a) && neg:
+		return 1 << 0
+	case neg && sub:
+		return 1 << 2
+	case f.isZero(a) && neg:
+		return 1 << 3
+	case neg && !f.isNaN(a):
+		return 1 << 1
+	case f.isZero(a):
+		return 1 << 4
+	case sub:
+		return 1 << 5
+	case f.isInf(a):
+		return 1 << 7
+	case f.isSNaN(a):
+		return 1 << 8
+	case f.isNaN(a):
+		return 1 << 9
+	}
+	return 1 << 6
+}
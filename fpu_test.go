@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFPU(t *testing.T) {
+	d := math.Float64bits
+	s := func(f float32) uint64 { return uint64(math.Float32bits(f)) }
+
+	tests := []struct {
+		name   string
+		fn     func() (uint64, uint64)
+		want   uint64
+		wantFl uint64
+	}{
+		{"add inexact", func() (uint64, uint64) { return double.add(d(1), d(0x1p-60), rne) }, d(1), fflagNX},
+		{"add rup", func() (uint64, uint64) { return double.add(d(1), d(0x1p-60), rup) }, d(1 + 0x1p-52), fflagNX},
+		{"add inf-inf", func() (uint64, uint64) { return double.add(d(math.Inf(1)), d(math.Inf(-1)), rne) }, double.qnan(), fflagNV},
+		{"sub exact zero rdn", func() (uint64, uint64) { return double.sub(d(1), d(1), rdn) }, d(math.Copysign(0, -1)), 0},
+		{"mul overflow", func() (uint64, uint64) { return double.mul(d(math.MaxFloat64), d(2), rne) }, d(math.Inf(1)), fflagOF | fflagNX},
+		{"mul overflow rtz", func() (uint64, uint64) { return double.mul(d(math.MaxFloat64), d(2), rtz) }, d(math.MaxFloat64), fflagOF | fflagNX},
+		{"mul underflow", func() (uint64, uint64) { return double.mul(d(math.SmallestNonzeroFloat64), d(0.5), rne) }, 0, fflagUF | fflagNX},
+		{"mul subnormal exact", func() (uint64, uint64) { return double.mul(d(0x1p-1070), d(0.5), rne) }, d(0x1p-1071), 0},
+		{"mul inf*0", func() (uint64, uint64) { return single.mul(s(float32(math.Inf(1))), s(0), rne) }, single.qnan(), fflagNV},
+		{"div by zero", func() (uint64, uint64) { return single.div(s(1), s(0), rne) }, s(float32(math.Inf(1))), fflagDZ},
+		{"div rmm", func() (uint64, uint64) { return single.div(s(1), s(3), rmm) }, s(float32(1.0 / 3)), fflagNX},
+		{"sqrt negative", func() (uint64, uint64) { return single.sqrt(s(-1), rne) }, single.qnan(), fflagNV},
+		{"sqrt -0", func() (uint64, uint64) { return double.sqrt(d(math.Copysign(0, -1)), rne) }, d(math.Copysign(0, -1)), 0},
+		{"sqrt snan", func() (uint64, uint64) { return double.sqrt(0x7ff0000000000001, rne) }, double.qnan(), fflagNV},
+		{"fma inf*0+qnan", func() (uint64, uint64) { return double.fma(d(math.Inf(1)), 0, double.qnan(), false, false, rne) }, double.qnan(), fflagNV},
+		{"fma single rounding", func() (uint64, uint64) {
+			return double.fma(d(1+0x1p-52), d(1-0x1p-52), d(-1), false, false, rne)
+		}, d(-0x1p-104), 0},
+		{"fnmsub", func() (uint64, uint64) { return single.fma(s(2), s(3), s(1), true, false, rne) }, s(-5), 0},
+		{"convert d to s", func() (uint64, uint64) { return double.convert(single, d(1e300), rne) }, s(float32(math.Inf(1))), fflagOF | fflagNX},
+		{"convert s to d nan", func() (uint64, uint64) { return single.convert(double, 0x7f800001, rne) }, double.qnan(), fflagNV},
+		{"to int32 nan", func() (uint64, uint64) { return double.toInt(double.qnan(), rne, 32, true) }, 0x7fffffff, fflagNV},
+		{"to uint32 max", func() (uint64, uint64) { return double.toInt(d(1e20), rne, 32, false) }, 0xffffffff_ffffffff, fflagNV},
+		{"to uint32 small negative", func() (uint64, uint64) { return double.toInt(d(-0.5), rtz, 32, false) }, 0, fflagNX},
+		{"to uint32 negative", func() (uint64, uint64) { return double.toInt(d(-1), rtz, 32, false) }, 0, fflagNV},
+		{"to int64 min", func() (uint64, uint64) { return single.toInt(s(float32(math.Inf(-1))), rne, 64, true) }, 1 << 63, fflagNV},
+		{"to int64 rdn", func() (uint64, uint64) { return double.toInt(d(-2.5), rdn, 64, true) }, uint64(0xffff_ffff_ffff_fffd), fflagNX},
+		{"from int", func() (uint64, uint64) { return single.fromInt(uint64(1<<24+1), true, rne) }, s(1 << 24), fflagNX},
+		{"from negative int", func() (uint64, uint64) { return double.fromInt(uint64(0xffff_ffff_ffff_fffe), true, rne) }, d(-2), 0},
+		{"eq snan", func() (uint64, uint64) { return single.eq(0x7f800001, s(0)) }, 0, fflagNV},
+		{"eq qnan", func() (uint64, uint64) { return single.eq(single.qnan(), s(0)) }, 0, 0},
+		{"lt qnan", func() (uint64, uint64) { return single.lt(single.qnan(), s(0)) }, 0, fflagNV},
+		{"le zeros", func() (uint64, uint64) { return double.le(d(math.Copysign(0, -1)), 0) }, 1, 0},
+		{"min zeros", func() (uint64, uint64) { return double.minmax(0, d(math.Copysign(0, -1)), false) }, d(math.Copysign(0, -1)), 0},
+		{"max nan", func() (uint64, uint64) { return single.minmax(single.qnan(), s(1), true) }, s(1), 0},
+		{"max snans", func() (uint64, uint64) { return single.minmax(0x7f800001, 0xff800001, true) }, single.qnan(), fflagNV},
+		{"classify subnormal", func() (uint64, uint64) { return double.classify(0x8000000000000001), 0 }, 1 << 2, 0},
+		{"classify qnan", func() (uint64, uint64) { return single.classify(single.qnan()), 0 }, 1 << 9, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, fl := tc.fn()
+			if got != tc.want || fl != tc.wantFl {
+				t.Errorf("got %#x (fflags %#x), want %#x (fflags %#x)", got, fl, tc.want, tc.wantFl)
+			}
+		})
+	}
+}
+
+func TestDoubleInst(t *testing.T) {
+	d := math.Float64bits
+	fa0 := func(cpu *CPU) uint64 { return cpu.fregs[10] }
+	a0 := func(cpu *CPU) uint64 { return cpu.xregs[10] }
+	mem := func(cpu *CPU) uint64 { return cpu.ram.Read(drambase+8, doubleword) }
+
+	tests := []struct {
+		name     string
+		inst     uint64
+		fa1, fa2 uint64
+		a1       uint64
+		got      func(cpu *CPU) uint64
+		want     uint64
+		wantFl   uint64
+	}{
+		{"fadd.d", 0x02c5f553, d(1.5), d(2.25), 0, fa0, d(3.75), 0},
+		{"fadd.d inexact", 0x02c5f553, d(1), d(0x1p-60), 0, fa0, d(1), fflagNX},
+		{"fcvt.w.d rtz", 0xc2059553, d(-2.5), 0, 0, a0, uint64(0xffff_ffff_ffff_fffe), fflagNX},
+		{"fcvt.w.d overflow", 0xc2059553, d(1e10), 0, 0, a0, 0x7fffffff, fflagNV},
+		{"fcvt.d.l", 0xd225f553, 0, 0, uint64(0xffff_ffff_ffff_fffd), fa0, d(-3), 0},
+		{"fcvt.d.s", 0x42058553, 0xffffffff_00000000 | uint64(math.Float32bits(0.5)), 0, 0, fa0, d(0.5), 0},
+		{"fcvt.d.s not NaN-boxed", 0x42058553, uint64(math.Float32bits(0.5)), 0, 0, fa0, double.qnan(), 0},
+		{"fcvt.s.d is NaN-boxed", 0x4015f553, d(0.5), 0, 0, fa0, 0xffffffff_00000000 | uint64(math.Float32bits(0.5)), 0},
+		{"fmv.x.d", 0xe2058553, d(-1.25), 0, 0, a0, d(-1.25), 0},
+		{"fmv.d.x", 0xf2058553, 0, 0, 0x7ff0000000000001, fa0, 0x7ff0000000000001, 0},
+		{"fsgnjn.d", 0x22b59553, d(2), 0, 0, fa0, d(-2), 0},
+		{"fsd", 0x00b5b427, d(-7), 0, drambase, mem, d(-7), 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.wcsr(mstatus, 1<<13) // FS=Initial
+			cpu.fregs[11], cpu.fregs[12] = tc.fa1, tc.fa2
+			cpu.xregs[11] = tc.a1
+
+			if excp := cpu.exec(tc.inst, drambase); excp != nil {
+				t.Fatalf("unexpected trap: %+v", excp)
+			}
+			if got, fl := tc.got(cpu), cpu.rcsr(fflags); got != tc.want || fl != tc.wantFl {
+				t.Errorf("got %#x (fflags %#x), want %#x (fflags %#x)", got, fl, tc.want, tc.wantFl)
+			}
+		})
+	}
+
+	// writing a floating-point register makes FS dirty.
+	cpu := NewCPU(defaultRAMSize)
+	cpu.wcsr(mstatus, 1<<13)
+	cpu.xregs[11] = drambase
+	if excp := cpu.exec(0x00b5b427, drambase); excp != nil { // fsd fa1, 8(a1)
+		t.Fatalf("fsd: %+v", excp)
+	}
+	if got := cpu.rcsr(mstatus); got&(3<<13|1<<63) != 1<<13 {
+		t.Errorf("fsd must not make FS dirty: mstatus %#x", got)
+	}
+	if excp := cpu.exec(0x0085b507, drambase); excp != nil { // fld fa0, 8(a1)
+		t.Fatalf("fld: %+v", excp)
+	}
+	if got := cpu.rcsr(mstatus); got&(3<<13|1<<63) != 3<<13|1<<63 {
+		t.Errorf("fld must make FS dirty: mstatus %#x", got)
+	}
+
+	// every floating-point instruction is illegal when FS is off.
+	cpu.wcsr(mstatus, 0)
+	cpu.fregs[10] = 0
+	for _, inst := range []uint64{0x02c5f553, 0xe2058553, 0x00b5b427, 0x0085b507} {
+		excp := cpu.exec(inst, drambase)
+		if excp == nil || excp.code != illegalInst || excp.value != inst {
+			t.Errorf("%#x with FS off: want illegal instruction, got %+v", inst, excp)
+		}
+	}
+	if cpu.fregs[10] != 0 || cpu.rcsr(mstatus)&(3<<13) != 0 {
+		t.Errorf("state is changed with FS off: fa0 %#x, mstatus %#x", cpu.fregs[10], cpu.rcsr(mstatus))
+	}
+}
+
+func TestSingleInst(t *testing.T) {
+	box := func(f float32) uint64 { return 0xffffffff_00000000 | uint64(math.Float32bits(f)) }
+	fa0 := func(cpu *CPU) uint64 { return cpu.fregs[10] }
+	a0 := func(cpu *CPU) uint64 { return cpu.xregs[10] }
+	mem := func(cpu *CPU) uint64 { return cpu.ram.Read(drambase+8, doubleword) }
+
+	tests := []struct {
+		name          string
+		inst          uint64
+		fa1, fa2, fa3 uint64
+		a1            uint64
+		got           func(cpu *CPU) uint64
+		want          uint64
+		wantFl        uint64
+	}{
+		{"fadd.s", 0x00c5f553, box(1.5), box(2.25), 0, 0, fa0, box(3.75), 0},
+		{"fadd.s not NaN-boxed", 0x00c5f553, uint64(math.Float32bits(1)), box(1), 0, 0, fa0, 0xffffffff_00000000 | single.qnan(), 0},
+		{"fdiv.s by zero", 0x18c5f553, box(1), box(0), 0, 0, fa0, box(float32(math.Inf(1))), fflagDZ},
+		{"fsqrt.s negative", 0x5805f553, box(-1), 0, 0, 0, fa0, 0xffffffff_00000000 | single.qnan(), fflagNV},
+		{"fmadd.s", 0x68c5f543, box(2), box(3), box(1), 0, fa0, box(7), 0},
+		{"fmin.s", 0x28c58553, box(float32(math.Copysign(0, -1))), box(0), 0, 0, fa0, box(float32(math.Copysign(0, -1))), 0},
+		{"feq.s", 0xa0c5a553, box(1), box(1), 0, 0, a0, 1, 0},
+		{"fclass.s", 0xe0059553, box(float32(math.Inf(-1))), 0, 0, 0, a0, 1, 0},
+		{"fcvt.w.s rtz", 0xc0059553, box(-2.5), 0, 0, 0, a0, uint64(0xffff_ffff_ffff_fffe), fflagNX},
+		{"fcvt.s.w", 0xd005f553, 0, 0, 0, uint64(0xffff_ffff_ffff_fffd), fa0, box(-3), 0},
+		{"fmv.x.w sign-extends", 0xe0058553, box(-1), 0, 0, 0, a0, 0xffffffff_bf800000, 0},
+		{"fmv.x.w ignores NaN-boxing", 0xe0058553, 0x12345678_3f800000, 0, 0, 0, a0, 0x3f800000, 0},
+		{"fmv.w.x", 0xf0058553, 0, 0, 0, 0xffff0000_7f800001, fa0, 0xffffffff_7f800001, 0},
+		{"fsw", 0x00b5a427, box(2), 0, 0, drambase, mem, uint64(math.Float32bits(2)), 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			cpu.wcsr(mstatus, 1<<13) // FS=Initial
+			cpu.fregs[11], cpu.fregs[12], cpu.fregs[13] = tc.fa1, tc.fa2, tc.fa3
+			cpu.xregs[11] = tc.a1
+
+			if excp := cpu.exec(tc.inst, drambase); excp != nil {
+				t.Fatalf("unexpected trap: %+v", excp)
+			}
+			if got, fl := tc.got(cpu), cpu.rcsr(fflags); got != tc.want || fl != tc.wantFl {
+				t.Errorf("got %#x (fflags %#x), want %#x (fflags %#x)", got, fl, tc.want, tc.wantFl)
+			}
+		})
+	}
+
+	// flw NaN-boxes the loaded value.
+	cpu := NewCPU(defaultRAMSize)
+	cpu.wcsr(mstatus, 1<<13)
+	cpu.xregs[11] = drambase
+	cpu.ram.Write(drambase+8, 0xdeadbeef_40000000, doubleword)
+	if excp := cpu.exec(0x0085a507, drambase); excp != nil { // flw fa0, 8(a1)
+		t.Fatalf("flw: %+v", excp)
+	}
+	if got := cpu.fregs[10]; got != box(2) {
+		t.Errorf("flw: want %#x, got %#x", box(2), got)
+	}
+
+	cpu.wcsr(mstatus, 0)
+	if excp := cpu.exec(0x00c5f553, drambase); excp == nil || excp.code != illegalInst || excp.value != 0x00c5f553 {
+		t.Errorf("fadd.s with FS off: want illegal instruction, got %+v", excp)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HTIF (host-target interface) used by riscv-tests, riscv-pk and bare-metal newlib programs.
+// The program writes a command to tohost, and the host clears tohost when it takes the command.
+// A response is written to fromhost, which the program clears when it takes the response.
+// A command consists of device (63:56), command (55:48) and payload (47:0).
+const (
+	htifDevSyscall = 0
+	htifDevConsole = 1
+
+	htifCmdGetchar = 0
+	htifCmdPutchar = 1
+
+	// syscall numbers proxied to the host, which are the same as the ones used by riscv-pk.
+	sysOpenat = 56
+	sysClose  = 57
+	sysLseek  = 62
+	sysRead   = 63
+	sysWrite  = 64
+	sysExit   = 93
+	sysOpen   = 1024
+
+	atFdcwd = -100
+
+	// errno returned to the program
+	eNOENT = 2
+	eIO    = 5
+	eBADF  = 9
+	eACCES = 13
+	eFAULT = 14
+	eEXIST = 17
+	eINVAL = 22
+	eNOSYS = 38
+
+	pathMax = 4096
+
+	// read and write transfer this many bytes at most at once, and return the short count
+	// as the real ones do, not to make the host allocate as much as the program asks.
+	htifMaxTransfer = 64 * 1024
+)
+
+type htif struct {
+	ram      *Memory
+	tohost   uint64
+	fromhost uint64 // 0 if the program has no fromhost
+
+	// root is the host directory which the program can open files in. Empty root disables open.
+	root  string
+	files map[uint64]*os.File
+	next  uint64 // next file descriptor
+
+	in       func() (byte, bool) // console input
+	out, err io.Writer           // console output, and stderr of the program
+
+	getchar bool // getchar is waiting for the input
+
+	// resp is the response waiting for the program to clear fromhost.
+	resp        uint64
+	respPending bool
+}
+
+func newHTIF(ram *Memory, tohost, fromhost uint64, root string, in func() (byte, bool), out io.Writer) *htif {
+	return &htif{
+		ram:      ram,
+		tohost:   tohost,
+		fromhost: fromhost,
+		root:     root,
+		files:    map[uint64]*os.File{},
+		next:     3,
+		in:       in,
+		out:      out,
+		err:      os.Stderr,
+	}
+}
+
+// reset closes the files opened by the program and drops the commands in progress,
+// when the program exits or the machine is reset.
+func (h *htif) reset() {
+	for fd, f := range h.files {
+		f.Close()
+		delete(h.files, fd)
+	}
+	h.next = 3
+	h.getchar = false
+	h.respPending = false
+}
+
+// poll handles the command in tohost if any. exited is true if the program requested to exit.
+func (h *htif) poll() (exited bool, code uint64) {
+	h.flush()
+	h.answerGetchar()
+
+	cmd := h.ram.Read(h.tohost, doubleword)
+	if cmd == 0 {
+		return false, 0
+	}
+
+	dev, c, payload := cmd>>56, (cmd>>48)&0xff, cmd&0xffff_ffff_ffff
+	switch dev {
+	case htifDevSyscall:
+		if payload&1 == 1 {
+			h.ram.Write(h.tohost, 0, doubleword)
+			return true, payload >> 1
+		}
+
+		exited, code, done := h.syscall(payload)
+		if !done {
+			// leave the command in tohost to retry.
+			return false, 0
+		}
+		h.ram.Write(h.tohost, 0, doubleword)
+		if exited {
+			return true, code
+		}
+		h.respond(dev, c, 1)
+
+	case htifDevConsole:
+		switch c {
+		case htifCmdGetchar:
+			h.getchar = true
+			h.answerGetchar()
+		case htifCmdPutchar:
+			h.out.Write([]byte{byte(payload)})
+		}
+		h.ram.Write(h.tohost, 0, doubleword)
+
+	default:
+		// unknown device, just take the command.
+		h.ram.Write(h.tohost, 0, doubleword)
+	}
+
+	return false, 0
+}
+
+// respond sends the response to the program. It is kept until the program takes the previous one.
+func (h *htif) respond(dev, cmd, payload uint64) {
+	h.resp = dev<<56 | cmd<<48 | payload
+	h.respPending = true
+	h.flush()
+}
+
+// flush writes the pending response to fromhost if the program has cleared it.
+func (h *htif) flush() {
+	if !h.respPending {
+		return
+	}
+
+	if h.fromhost == 0 {
+		// the program does not take responses.
+		h.respPending = false
+		return
+	}
+
+	if h.ram.Read(h.fromhost, doubleword) != 0 {
+		return
+	}
+
+	h.ram.Write(h.fromhost, h.resp, doubleword)
+	h.respPending = false
+}
+
+// answerGetchar responds to the pending getchar when the input becomes available.
+func (h *htif) answerGetchar() {
+	if !h.getchar || h.respPending || h.fromhost == 0 || h.ram.Read(h.fromhost, doubleword) != 0 {
+		return
+	}
+
+	b, ok := h.in()
+	if !ok {
+		return
+	}
+
+	h.getchar = false
+	h.respond(htifDevConsole, htifCmdGetchar, uint64(b))
+}
+
+// syscall runs the syscall described by the 8 doublewords at addr: the syscall number and 7 arguments.
+// The result is written back to the first doubleword. done is false if the syscall must be retried later.
+func (h *htif) syscall(addr uint64) (exited bool, code uint64, done bool) {
+	if !h.ram.contains(addr, 8*8) {
+		return false, 0, true
+	}
+
+	var args [7]uint64
+	for i := range args {
+		args[i] = h.ram.Read(addr+8*uint64(i+1), doubleword)
+	}
+
+	var ret int64
+	switch n := h.ram.Read(addr, doubleword); n {
+	case sysExit:
+		return true, args[0], true
+	case sysWrite:
+		ret = h.write(args[0], args[1], args[2])
+	case sysRead:
+		ret, done = h.read(args[0], args[1], args[2])
+		if !done {
+			return false, 0, false
+		}
+	case sysOpenat:
+		if int64(args[0]) != atFdcwd {
+			ret = -eINVAL
+			break
+		}
+		ret = h.open(args[1], args[2], args[3])
+	case sysOpen:
+		ret = h.open(args[0], args[1], args[2])
+	case sysClose:
+		ret = h.close(args[0])
+	case sysLseek:
+		ret = h.lseek(args[0], args[1], args[2])
+	default:
+		ret = -eNOSYS
+	}
+
+	h.ram.Write(addr, uint64(ret), doubleword)
+	return false, 0, true
+}
+
+func (h *htif) write(fd, buf, n uint64) int64 {
+	if !h.ram.contains(buf, n) {
+		return -eFAULT
+	}
+
+	var w io.Writer
+	switch fd {
+	case 1:
+		w = h.out
+	case 2:
+		w = h.err
+	default:
+		f, ok := h.files[fd]
+		if !ok {
+			return -eBADF
+		}
+		w = f
+	}
+
+	if n > htifMaxTransfer {
+		n = htifMaxTransfer
+	}
+	data := make([]byte, n)
+	h.ram.ReadBytes(buf, data)
+
+	written, err := w.Write(data)
+	if err != nil {
+		return errno(err)
+	}
+	return int64(written)
+}
+
+// read reads from the file. Reading the console is not done until the input is available.
+func (h *htif) read(fd, buf, n uint64) (ret int64, done bool) {
+	if !h.ram.contains(buf, n) {
+		return -eFAULT, true
+	}
+	if n > htifMaxTransfer {
+		n = htifMaxTransfer
+	}
+
+	if fd == 0 {
+		if n == 0 {
+			return 0, true
+		}
+
+		i := uint64(0)
+		for ; i < n; i++ {
+			b, ok := h.in()
+			if !ok {
+				break
+			}
+			h.ram.Write(buf+i, uint64(b), byt)
+		}
+		return int64(i), i > 0
+	}
+
+	f, ok := h.files[fd]
+	if !ok {
+		return -eBADF, true
+	}
+
+	data := make([]byte, n)
+	read, err := f.Read(data)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errno(err), true
+	}
+
+	h.ram.WriteBytes(buf, data[:read])
+	return int64(read), true
+}
+
+func (h *htif) open(path, flags, mode uint64) int64 {
+	if h.root == "" {
+		return -eACCES
+	}
+
+	name, ok := h.readString(path)
+	if !ok {
+		return -eFAULT
+	}
+
+	name, ret := h.resolve(name)
+	if ret != 0 {
+		return ret
+	}
+
+	f, err := os.OpenFile(name, hostFlags(flags), fs.FileMode(mode&0o777))
+	if err != nil {
+		return errno(err)
+	}
+
+	fd := h.next
+	h.next++
+	h.files[fd] = f
+	return int64(fd)
+}
+
+// resolve returns the host path of the file in the root. The path is resolved in the root even if
+// it is absolute or contains "..", and symbolic links must not point out of the root.
+func (h *htif) resolve(name string) (string, int64) {
+	root, err := filepath.EvalSymlinks(h.root)
+	if err != nil {
+		return "", errno(err)
+	}
+
+	path := filepath.Join(root, filepath.Clean("/"+name))
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the file to be created does not exist yet, so its directory is resolved.
+		// The name must not be a dangling symbolic link as it is followed on create.
+		if _, err := os.Lstat(path); err == nil {
+			return "", -eACCES
+		}
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return "", errno(err)
+		}
+		resolved = filepath.Join(dir, filepath.Base(path))
+	} else if err != nil {
+		return "", errno(err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", -eACCES
+	}
+	return resolved, 0
+}
+
+func (h *htif) close(fd uint64) int64 {
+	if fd <= 2 {
+		// keep the host console open.
+		return 0
+	}
+
+	f, ok := h.files[fd]
+	if !ok {
+		return -eBADF
+	}
+
+	delete(h.files, fd)
+	if err := f.Close(); err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (h *htif) lseek(fd, offset, whence uint64) int64 {
+	f, ok := h.files[fd]
+	if !ok {
+		return -eBADF
+	}
+
+	if whence > io.SeekEnd {
+		return -eINVAL
+	}
+
+	pos, err := f.Seek(int64(offset), int(whence))
+	if err != nil {
+		return errno(err)
+	}
+	return pos
+}
+
+// readString reads the NUL-terminated string.
+func (h *htif) readString(addr uint64) (string, bool) {
+	var s []byte
+	for i := uint64(0); i < pathMax; i++ {
+		if !h.ram.contains(addr+i, 1) {
+			return "", false
+		}
+
+		b := byte(h.ram.Read(addr+i, byt))
+		if b == 0 {
+			return string(s), true
+		}
+		s = append(s, b)
+	}
+
+	return "", false
+}
+
+// hostFlags converts the open flags of the program, which are Linux's, to the host ones.
+func hostFlags(flags uint64) int {
+	f := int(flags & 3) // O_RDONLY, O_WRONLY and O_RDWR
+	if flags&0x40 != 0 {
+		f |= os.O_CREATE
+	}
+	if flags&0x80 != 0 {
+		f |= os.O_EXCL
+	}
+	if flags&0x200 != 0 {
+		f |= os.O_TRUNC
+	}
+	if flags&0x400 != 0 {
+		f |= os.O_APPEND
+	}
+	return f
+}
+
+// errno returns the negated errno for the host error.
+func errno(err error) int64 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return -eNOENT
+	case errors.Is(err, fs.ErrPermission):
+		return -eACCES
+	case errors.Is(err, fs.ErrExist):
+		return -eEXIST
+	}
+
+	return -eIO
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTIF(t *testing.T) {
+	const (
+		tohost   = drambase + 0x1000
+		fromhost = drambase + 0x1040
+		magic    = drambase + 0x2000
+		buf      = drambase + 0x3000
+	)
+
+	root := t.TempDir()
+	ram := NewMemory(0x10000)
+	input := []byte("in")
+	in := func() (byte, bool) {
+		if len(input) == 0 {
+			return 0, false
+		}
+		b := input[0]
+		input = input[1:]
+		return b, true
+	}
+
+	var out bytes.Buffer
+	h := newHTIF(ram, tohost, fromhost, root, in, &out)
+
+	putString := func(addr uint64, s string) {
+		for i := 0; i < len(s); i++ {
+			ram.Write(addr+uint64(i), uint64(s[i]), byt)
+		}
+		ram.Write(addr+uint64(len(s)), 0, byt)
+	}
+
+	syscall := func(n uint64, args ...uint64) int64 {
+		t.Helper()
+		ram.Write(magic, n, doubleword)
+		for i, a := range args {
+			ram.Write(magic+8*uint64(i+1), a, doubleword)
+		}
+		ram.Write(tohost, magic, doubleword)
+		if exited, _ := h.poll(); exited {
+			t.Fatalf("syscall %d: unexpected exit", n)
+		}
+		if got := ram.Read(tohost, doubleword); got != 0 {
+			t.Fatalf("syscall %d: tohost is not cleared: %#x", n, got)
+		}
+		if got := ram.Read(fromhost, doubleword); got != 1 {
+			t.Fatalf("syscall %d: fromhost: want 1, got %#x", n, got)
+		}
+		ram.Write(fromhost, 0, doubleword)
+		return int64(ram.Read(magic, doubleword))
+	}
+
+	// console
+	ram.Write(tohost, htifDevConsole<<56|htifCmdPutchar<<48|'a', doubleword)
+	h.poll()
+	putString(buf, "bc")
+	if got := syscall(sysWrite, 1, buf, 2); got != 2 {
+		t.Fatalf("write: want 2, got %d", got)
+	}
+	if out.String() != "abc" {
+		t.Fatalf("console: want abc, got %q", out.String())
+	}
+
+	ram.Write(tohost, htifDevConsole<<56|htifCmdGetchar<<48, doubleword)
+	h.poll()
+	if got := ram.Read(fromhost, doubleword); got != htifDevConsole<<56|htifCmdGetchar<<48|'i' {
+		t.Fatalf("getchar: %#x", got)
+	}
+	ram.Write(fromhost, 0, doubleword)
+	if got := syscall(sysRead, 0, buf, 8); got != 1 || ram.Read(buf, byt) != 'n' {
+		t.Fatalf("read console: got %d", got)
+	}
+
+	// files are opened in the root even if the path goes out of it
+	putString(buf, "../../file")
+	fd := syscall(sysOpenat, ^uint64(99), buf, 0x241, 0o644) // AT_FDCWD, O_WRONLY|O_CREAT|O_TRUNC
+	if fd < 3 {
+		t.Fatalf("openat: %d", fd)
+	}
+	putString(buf+0x100, "hello")
+	if got := syscall(sysWrite, uint64(fd), buf+0x100, 5); got != 5 {
+		t.Fatalf("write file: %d", got)
+	}
+	if got := syscall(sysClose, uint64(fd)); got != 0 {
+		t.Fatalf("close: %d", got)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "file")); err != nil || string(got) != "hello" {
+		t.Fatalf("file: %q, %v", got, err)
+	}
+
+	fd = syscall(sysOpen, buf, 0, 0)
+	if got := syscall(sysRead, uint64(fd), buf+0x200, 16); got != 5 || ram.Read(buf+0x200, byt) != 'h' {
+		t.Fatalf("read file: %d", got)
+	}
+	if got := syscall(sysClose, uint64(fd)); got != 0 {
+		t.Fatalf("close: %d", got)
+	}
+
+	// symbolic links are followed only in the root
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644)
+	os.Symlink(outside, filepath.Join(root, "dir"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "secret"))
+	os.Symlink(filepath.Join(outside, "created"), filepath.Join(root, "dangling"))
+	os.Symlink("file", filepath.Join(root, "inner"))
+	for _, name := range []string{"dir/secret", "secret", "/dir/../secret"} {
+		putString(buf, name)
+		if got := syscall(sysOpen, buf, 0, 0); got != -eACCES {
+			t.Errorf("open %s: want -EACCES, got %d", name, got)
+		}
+	}
+	putString(buf, "dangling")
+	if got := syscall(sysOpen, buf, 0x41, 0o644); got != -eACCES { // O_WRONLY|O_CREAT
+		t.Errorf("create via dangling link: want -EACCES, got %d", got)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "created")); err == nil {
+		t.Errorf("file is created out of the root")
+	}
+	putString(buf, "inner")
+	fd = syscall(sysOpen, buf, 0, 0)
+	if fd < 3 {
+		t.Fatalf("open link in the root: %d", fd)
+	}
+	if got := syscall(sysClose, uint64(fd)); got != 0 {
+		t.Fatalf("close: %d", got)
+	}
+
+	putString(buf, "missing")
+	if got := syscall(sysOpen, buf, 0, 0); got != -eNOENT {
+		t.Fatalf("open missing file: %d", got)
+	}
+	if got := syscall(sysClose, 100); got != -eBADF {
+		t.Fatalf("close bad fd: %d", got)
+	}
+	if got := syscall(0xfff); got != -eNOSYS {
+		t.Fatalf("unknown syscall: %d", got)
+	}
+
+	// the response waits until the program takes the previous one
+	ram.Write(fromhost, 0xdead, doubleword)
+	ram.Write(magic, sysClose, doubleword)
+	ram.Write(magic+8, 100, doubleword)
+	ram.Write(tohost, magic, doubleword)
+	h.poll()
+	if got := ram.Read(tohost, doubleword); got != 0 {
+		t.Fatalf("tohost is not cleared: %#x", got)
+	}
+	if got := ram.Read(fromhost, doubleword); got != 0xdead {
+		t.Fatalf("fromhost is overwritten: %#x", got)
+	}
+	ram.Write(fromhost, 0, doubleword)
+	h.poll()
+	if got := ram.Read(fromhost, doubleword); got != 1 {
+		t.Fatalf("pending response: want 1, got %#x", got)
+	}
+	if got := int64(ram.Read(magic, doubleword)); got != -eBADF {
+		t.Fatalf("pending response: want -EBADF, got %d", got)
+	}
+	ram.Write(fromhost, 0, doubleword)
+
+	// exit
+	ram.Write(tohost, 3<<1|1, doubleword)
+	if exited, code := h.poll(); !exited || code != 3 {
+		t.Fatalf("exit: %t, %d", exited, code)
+	}
+	ram.Write(magic, sysExit, doubleword)
+	ram.Write(magic+8, 4, doubleword)
+	ram.Write(tohost, magic, doubleword)
+	if exited, code := h.poll(); !exited || code != 4 {
+		t.Fatalf("exit syscall: %t, %d", exited, code)
+	}
+}
+
+func TestHTIFTransferAndReset(t *testing.T) {
+	const (
+		tohost   = drambase + 0x1000
+		fromhost = drambase + 0x1040
+		magic    = drambase + 0x2000
+		name     = drambase + 0x2800
+		buf      = drambase + 0x3000
+		size     = 1 << 20
+	)
+
+	root := t.TempDir()
+	ram := NewMemory(size)
+	h := newHTIF(ram, tohost, fromhost, root, func() (byte, bool) { return 0, false }, &bytes.Buffer{})
+
+	syscall := func(n uint64, args ...uint64) int64 {
+		t.Helper()
+		ram.Write(magic, n, doubleword)
+		for i, a := range args {
+			ram.Write(magic+8*uint64(i+1), a, doubleword)
+		}
+		ram.Write(tohost, magic, doubleword)
+		h.poll()
+		ram.Write(fromhost, 0, doubleword)
+		return int64(ram.Read(magic, doubleword))
+	}
+
+	data := make([]byte, 3*htifMaxTransfer)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	ram.WriteBytes(buf+1, data) // not aligned to the page
+	ram.Write(name, 'f', halfword)
+
+	// a long transfer is done partially
+	fd := syscall(sysOpen, name, 0x42, 0o644) // O_RDWR|O_CREAT
+	if fd < 3 {
+		t.Fatalf("open: %d", fd)
+	}
+	if got := syscall(sysWrite, uint64(fd), buf+1, size-0x4000); got != htifMaxTransfer {
+		t.Fatalf("write: want %d, got %d", htifMaxTransfer, got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(root, "f")); !bytes.Equal(got, data[:htifMaxTransfer]) {
+		t.Fatalf("written data differs")
+	}
+	if got := syscall(sysWrite, uint64(fd), buf+1, size); got != -eFAULT {
+		t.Fatalf("write out of RAM: want -EFAULT, got %d", got)
+	}
+
+	syscall(sysLseek, uint64(fd), 0, 0)
+	ram.WriteBytes(buf+1, make([]byte, len(data)))
+	if got := syscall(sysRead, uint64(fd), buf+1, size-0x4000); got != htifMaxTransfer {
+		t.Fatalf("read: want %d, got %d", htifMaxTransfer, got)
+	}
+	got := make([]byte, htifMaxTransfer)
+	ram.ReadBytes(buf+1, got)
+	if !bytes.Equal(got, data[:htifMaxTransfer]) {
+		t.Fatalf("read data differs")
+	}
+
+	// reset closes the files
+	f := h.files[uint64(fd)]
+	h.reset()
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Fatalf("file is not closed")
+	}
+	if got := syscall(sysWrite, uint64(fd), buf, 1); got != -eBADF {
+		t.Fatalf("write after reset: want -EBADF, got %d", got)
+	}
+	if got := syscall(sysOpen, name, 0, 0); got != fd {
+		t.Fatalf("fd after reset: want %d, got %d", fd, got)
+	}
+}
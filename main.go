@@ -2,9 +2,12 @@ package main
 
 import (
 	"debug/elf"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"time"
 )
 
 var dbg bool
@@ -14,23 +17,87 @@ type RV struct {
 	// tohost is an special address which shows a message from program to the host.
 	// For now, tohost is used to terminate the execution of riscv-tests program.
 	// https://riscv.org/wp-content/uploads/2015/01/riscv-testing-frameworks-bootcamp-jan2015.pdf
+	// 0 means the program does not use HTIF.
 	tohost uint64
+	// fromhost is the address where the host writes a response to the program.
+	fromhost uint64
+	// htifRoot is the host directory which the program can open files in by HTIF syscalls.
+	htifRoot string
+	// exit is set when the program requests to exit.
+	exit *exitStatus
+
+	// the program loaded on boot and reset
+	segments []segment
+	entry    uint64
+}
+
+// segment is a loadable segment of the program.
+type segment struct {
+	addr  uint64
+	data  []byte
+	memsz uint64 // the rest of data is zero-filled
+}
+
+// exitStatus describes how the program exited.
+type exitStatus struct {
+	code  uint64
+	cause string // what the program used to exit, e.g. "htif"
+}
+
+// exitError is returned when the program exits with a non-zero code.
+type exitError struct {
+	status *exitStatus
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("program exited with code %d by %s", e.status.code, e.status.cause)
+}
+
+// exitCode returns the process exit status for the program's exit code.
+// A non-zero code never becomes 0 even if the lower 8 bits are all zero.
+func (e *exitError) exitCode() int {
+	if c := int(e.status.code & 0xff); c != 0 {
+		return c
+	}
+	return 1
 }
 
 func (r *RV) Start() error {
+	var h *htif
+	if r.tohost != 0 {
+		// HTIF shares the console with the UART.
+		h = newHTIF(r.cpu.ram, r.tohost, r.fromhost, r.htifRoot, r.cpu.uart.readInput, r.cpu.uart.out)
+		defer h.reset()
+	}
+
 	for {
-		r.cpu.tick()
+		if err := r.cpu.tick(); err != nil {
+			return err
+		}
 
-		if r.tohost == 0 {
-			continue
+		if f := r.cpu.finisher; f.requested {
+			if f.reboot {
+				r.reset()
+				if h != nil {
+					h.reset()
+				}
+				continue
+			}
+
+			r.exit = &exitStatus{code: f.code, cause: "test finisher"}
 		}
 
-		if code := r.cpu.ram.Read(r.tohost, word); code != 0 {
-			if code == 1 {
-				return nil
+		if h != nil {
+			if exited, code := h.poll(); exited {
+				r.exit = &exitStatus{code: code, cause: "htif"}
 			}
+		}
 
-			return fmt.Errorf("terminated, the tohost code is not success but %v", code)
+		if r.exit != nil {
+			if r.exit.code != 0 {
+				return &exitError{status: r.exit}
+			}
+			return nil
 		}
 	}
 }
@@ -43,6 +110,12 @@ func debug(format string, a ...any) {
 
 func main() {
 	if err := run(); err != nil {
+		// the exit code of the program is passed through as is.
+		var ee *exitError
+		if errors.As(err, &ee) {
+			os.Exit(ee.exitCode())
+		}
+
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
@@ -52,40 +125,114 @@ func run() error {
 	var (
 		program = flag.String("p", "", "ELF program to run")
 		d       = flag.Bool("d", false, "print out debug log if specified")
+		halt    = flag.Bool("halt-on-illegal", false, "stop the emulation on the first illegal instruction instead of trapping")
+		disk    = flag.String("disk", "", "disk image file for the virtio block device")
+		args    = flag.String("bootargs", "", "kernel command line passed in the device tree")
+		dumpDTB = flag.String("dump-dtb", "", "write the device tree blob to the file and exit")
+		mem     = flag.String("m", "3G", "memory size, suffixed by K, M or G (default unit is M)")
+		tohost  = flag.Uint64("tohost", 0, "address of tohost, overriding the symbol in the ELF")
+		noHTIF  = flag.Bool("no-htif", false, "run the program without tohost, which exits by the test finisher (e.g. a kernel)")
+		root    = flag.String("htif-root", "", "host directory which the program can open files in by HTIF syscalls")
+		summary = flag.Bool("summary", false, "print a summary of the execution to stderr on exit")
+		misal   = flag.String("misaligned", "emulate", "how to handle misaligned loads and stores: \"emulate\" or \"trap\"")
+		cons    = flag.String("console", "stdio", "console of the UART and HTIF: \"stdio\", \"none\", \"file:PATH\", \"unix:PATH\", \"tcp:PORT\" or \"pty\"")
 	)
 
 	flag.Parse()
 
 	dbg = *d
 
+	if *misal != "emulate" && *misal != "trap" {
+		return fmt.Errorf("invalid -misaligned: %q, must be \"emulate\" or \"trap\"", *misal)
+	}
+
+	ramSize, err := parseMemorySize(*mem)
+	if err != nil {
+		return err
+	}
+
+	dtb := makeDTB(ramSize, *args)
+	if *dumpDTB != "" {
+		if err := os.WriteFile(*dumpDTB, dtb, 0o644); err != nil {
+			return fmt.Errorf("dump device tree: %w", err)
+		}
+		return nil
+	}
+
 	file := *program
 	if file == "" {
 		return fmt.Errorf("program must be passed with -p option")
 	}
 
-	cpu, err := initCPU(file)
+	cpu, err := initCPU(file, ramSize)
 	if err != nil {
 		return fmt.Errorf("initialize emulator: %w", err)
 	}
 
-	if err := cpu.Start(); err != nil {
-		return fmt.Errorf("run program: %w", err)
+	if *tohost != 0 {
+		if !cpu.cpu.ram.contains(*tohost, 8) {
+			return fmt.Errorf("tohost %#x is out of the memory", *tohost)
+		}
+		cpu.tohost = *tohost
 	}
 
-	return nil
-}
+	// without tohost, the program can exit only by the test finisher.
+	if cpu.tohost == 0 && !*noHTIF {
+		return fmt.Errorf("tohost is not found in %s, pass its address by -tohost, or -no-htif if the program exits by the test finisher", file)
+	}
+
+	cpu.htifRoot = *root
+	cpu.cpu.haltOnIllegal = *halt
+	cpu.cpu.trapMisaligned = *misal == "trap"
 
-func initCPU(filename string) (*RV, error) {
-	of, err := os.Open(filename)
+	if err := cpu.cpu.loadDTB(dtb); err != nil {
+		return fmt.Errorf("load device tree: %w", err)
+	}
+
+	if *disk != "" {
+		f, err := os.OpenFile(*disk, os.O_RDWR, 0)
+		if err != nil {
+			return fmt.Errorf("open disk image: %w", err)
+		}
+		defer f.Close()
+
+		if err := cpu.cpu.disk.attach(f); err != nil {
+			return fmt.Errorf("attach disk image: %w", err)
+		}
+	}
+
+	c, err := openConsole(*cons)
 	if err != nil {
-		return nil, fmt.Errorf("open elf file: %w", err)
+		return err
+	}
+	defer c.close()
+	cpu.cpu.uart.attach(c.in, c.out)
+
+	start := time.Now()
+	err = cpu.Start()
+	if *summary {
+		cause := "error"
+		if cpu.exit != nil {
+			cause = fmt.Sprintf("exit code %d by %s", cpu.exit.code, cpu.exit.cause)
+		}
+		fmt.Fprintf(os.Stderr, "rv: %s, %d instructions retired in %s\n", cause, cpu.cpu.csr[instret], time.Since(start).Round(time.Millisecond))
 	}
 
+	var ee *exitError
+	if err != nil && !errors.As(err, &ee) {
+		return fmt.Errorf("run program: %w", err)
+	}
+
+	return err
+}
+
+func initCPU(filename string, ramSize uint64) (*RV, error) {
 	// load elf file
 	f, err := elf.Open(filename)
 	if err != nil {
 		return nil, fmt.Errorf("open elf file: %w", err)
 	}
+	defer f.Close()
 
 	if f.Data != elf.ELFDATA2LSB {
 		return nil, fmt.Errorf("elf must be little endian")
@@ -99,26 +246,87 @@ func initCPU(filename string) (*RV, error) {
 		return nil, fmt.Errorf("elf machine must be RISCV")
 	}
 
-	cpu := NewCPU()
+	cpu := NewCPU(ramSize)
+	rv := &RV{cpu: cpu, entry: f.Entry}
 
 	for _, p := range f.Progs {
 		if p.Type != elf.PT_LOAD {
 			continue
 		}
 
-		for i := 0; i < int(p.Filesz); i++ {
-			addr := p.Vaddr + uint64(i)
-			val := make([]byte, byt)
-			_, err := of.ReadAt(val, int64(p.Off)+int64(i))
-			if err != nil {
-				return nil, fmt.Errorf("read program header")
-			}
-			cpu.ram.Write(addr, uint64(val[0]), byt)
+		if !cpu.ram.contains(p.Vaddr, p.Memsz) {
+			return nil, fmt.Errorf("program segment at %#x does not fit in the memory", p.Vaddr)
 		}
+
+		data := make([]byte, p.Filesz)
+		if _, err := io.ReadFull(p.Open(), data); err != nil {
+			return nil, fmt.Errorf("read program segment at %#x: %w", p.Vaddr, err)
+		}
+
+		rv.segments = append(rv.segments, segment{addr: p.Vaddr, data: data, memsz: p.Memsz})
 	}
-	cpu.pc = f.Entry
 
-	rv := &RV{cpu: cpu, tohost: 0x80001000} // TODO: find tohost from sections
+	rv.load()
+
+	tohost, fromhost, err := findHTIF(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range []uint64{tohost, fromhost} {
+		if addr != 0 && !cpu.ram.contains(addr, 8) {
+			return nil, fmt.Errorf("HTIF symbol at %#x is out of the memory", addr)
+		}
+	}
+
+	rv.tohost, rv.fromhost = tohost, fromhost
 
 	return rv, nil
 }
+
+// load places the program in the memory and sets pc to the entry point.
+func (r *RV) load() {
+	for _, s := range r.segments {
+		for i := uint64(0); i < s.memsz; i++ {
+			v := uint64(0) // bss is zero-filled
+			if i < uint64(len(s.data)) {
+				v = uint64(s.data[i])
+			}
+			r.cpu.ram.Write(s.addr+i, v, byt)
+		}
+	}
+
+	r.cpu.pc = r.entry
+}
+
+// reset resets the machine and loads the program again, as the firmware expects its data
+// to be initialized on boot.
+func (r *RV) reset() {
+	r.cpu.reset()
+	r.load()
+	// the device tree is kept in the ROM, but a0 and a1 must be set again.
+	r.cpu.loadDTB(r.cpu.dtb.data)
+}
+
+// findHTIF returns the address of tohost and fromhost symbols in the ELF.
+// 0 is returned for the symbol which is not found.
+func findHTIF(f *elf.File) (tohost, fromhost uint64, err error) {
+	syms, err := f.Symbols()
+	if err != nil {
+		if errors.Is(err, elf.ErrNoSymbols) {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("read symbol table: %w", err)
+	}
+
+	for _, s := range syms {
+		switch s.Name {
+		case "tohost":
+			tohost = s.Value
+		case "fromhost":
+			fromhost = s.Value
+		}
+	}
+
+	return tohost, fromhost, nil
+}
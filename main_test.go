@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	for i, inst := range []uint64{
+		0x00001297, // auipc t0, 1
+		0x00700313, // li t1, 3<<1|1
+		0x0062b023, // sd t1, 0(t0)
+		0x0000006f, // j .
+	} {
+		cpu.ram.Write(drambase+uint64(i)*4, inst, word)
+	}
+	cpu.pc = drambase
+
+	r := &RV{cpu: cpu, tohost: drambase + 0x1000}
+	err := r.Start()
+
+	var ee *exitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("want exitError, got %v", err)
+	}
+	if ee.exitCode() != 3 || r.exit.cause != "htif" {
+		t.Fatalf("want code 3 by htif, got %d by %s", ee.exitCode(), r.exit.cause)
+	}
+	if got := cpu.csr[instret]; got != 3 {
+		t.Fatalf("instret: want 3, got %d", got)
+	}
+
+	// the lower 8 bits are zero, but it must not be success
+	if got := (&exitError{status: &exitStatus{code: 256}}).exitCode(); got != 1 {
+		t.Fatalf("want 1, got %d", got)
+	}
+}
+
+// makeELF returns an ELF file which has only the symbols. No symbol table is made if syms is nil.
+func makeELF(t *testing.T, syms map[string]uint64) *elf.File {
+	t.Helper()
+
+	var shstrtab, strtab, symtab bytes.Buffer
+	shstrtab.WriteString("\x00.symtab\x00.strtab\x00.shstrtab\x00")
+	strtab.WriteByte(0)
+	binary.Write(&symtab, binary.LittleEndian, elf.Sym64{}) // the first symbol is null
+	for name, value := range syms {
+		binary.Write(&symtab, binary.LittleEndian, elf.Sym64{
+			Name:  uint32(strtab.Len()),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT),
+			Shndx: uint16(elf.SHN_ABS),
+			Value: value,
+		})
+		strtab.WriteString(name + "\x00")
+	}
+
+	const headerSize = 64
+	sections := []elf.Section64{{}}
+	data := shstrtab.Bytes()
+	sections = append(sections, elf.Section64{Name: 17, Type: uint32(elf.SHT_STRTAB), Off: headerSize, Size: uint64(len(data))})
+	if syms != nil {
+		off := uint64(headerSize + len(data))
+		sections = append(sections,
+			elf.Section64{Name: 1, Type: uint32(elf.SHT_SYMTAB), Off: off, Size: uint64(symtab.Len()), Link: 3, Entsize: 24},
+			elf.Section64{Name: 9, Type: uint32(elf.SHT_STRTAB), Off: off + uint64(symtab.Len()), Size: uint64(strtab.Len())},
+		)
+		data = append(append(data, symtab.Bytes()...), strtab.Bytes()...)
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, elf.Header64{
+		Ident:     [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)},
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(headerSize + len(data)),
+		Ehsize:    headerSize,
+		Shentsize: 64,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  1,
+	})
+	buf.Write(data)
+	binary.Write(&buf, binary.LittleEndian, sections)
+
+	f, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFindHTIF(t *testing.T) {
+	tests := []struct {
+		name             string
+		syms             map[string]uint64
+		tohost, fromhost uint64
+	}{
+		{"both", map[string]uint64{"tohost": drambase + 0x1000, "fromhost": drambase + 0x1040, "main": drambase}, drambase + 0x1000, drambase + 0x1040},
+		{"no symbol table", nil, 0, 0},
+		{"only tohost", map[string]uint64{"tohost": drambase + 0x1000}, drambase + 0x1000, 0},
+	}
+
+	if _, err := makeELF(t, nil).Symbols(); !errors.Is(err, elf.ErrNoSymbols) {
+		t.Fatalf("want ErrNoSymbols, got %v", err)
+	}
+
+	for _, tc := range tests {
+		tohost, fromhost, err := findHTIF(makeELF(t, tc.syms))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if tohost != tc.tohost || fromhost != tc.fromhost {
+			t.Errorf("%s: want %#x, %#x, got %#x, %#x", tc.name, tc.tohost, tc.fromhost, tohost, fromhost)
+		}
+	}
+}
@@ -1,67 +1,184 @@
 package main
 
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
 const (
 	dramBase = 0x80000000
 	dtbSize  = 0xfe0
+
+	defaultRAMSize = 3 * 1024 * 1024 * 1024
+
+	memPageSize = 4096
 )
 
+// Memory is the DRAM. Pages are allocated lazily on the first write,
+// so that only the touched part of the memory consumes the host memory.
 type Memory struct {
-	// 3GiB
-	Mem [3 * 1024 * 1024 * 1024]uint8
+	size  uint64
+	pages []*[memPageSize]uint8
+}
+
+func NewMemory(size uint64) *Memory {
+	return &Memory{
+		size:  size,
+		pages: make([]*[memPageSize]uint8, (size+memPageSize-1)/memPageSize),
+	}
 }
 
-func NewMemory() *Memory {
-	return &Memory{Mem: [3 * 1024 * 1024 * 1024]uint8{}}
+// contains returns true if the memory has the range [addr, addr+length).
+// Read and Write must be called only for the address in the memory.
+func (mem *Memory) contains(addr, length uint64) bool {
+	return addr >= dramBase && length <= mem.size && addr-dramBase <= mem.size-length
 }
 
 func (mem *Memory) Read(addr uint64, size int) uint64 {
 	index := addr - dramBase
+	off := index % memPageSize
+	n := uint64(size / 8)
+
+	// access across the page boundary
+	if off+n > memPageSize {
+		v := uint64(0)
+		for i := uint64(0); i < n; i++ {
+			v |= mem.Read(addr+i, byt) << (i * 8)
+		}
+		return v
+	}
+
+	page := mem.pages[index/memPageSize]
+	if page == nil {
+		// not written yet
+		return 0
+	}
+
 	switch size {
 	case byt:
-		return uint64(mem.Mem[index])
+		return uint64(page[off])
 	case halfword:
-		return uint64(mem.Mem[index]) | uint64(mem.Mem[index+1])<<8
+		return uint64(binary.LittleEndian.Uint16(page[off:]))
 	case word:
-		return uint64(mem.Mem[index]) |
-			uint64(mem.Mem[index+1])<<8 |
-			uint64(mem.Mem[index+2])<<16 |
-			uint64(mem.Mem[index+3])<<24
+		return uint64(binary.LittleEndian.Uint32(page[off:]))
 	case doubleword:
-		return uint64(mem.Mem[index]) |
-			uint64(mem.Mem[index+1])<<8 |
-			uint64(mem.Mem[index+2])<<16 |
-			uint64(mem.Mem[index+3])<<24 |
-			uint64(mem.Mem[index+4])<<32 |
-			uint64(mem.Mem[index+5])<<40 |
-			uint64(mem.Mem[index+6])<<48 |
-			uint64(mem.Mem[index+7])<<56
+		return binary.LittleEndian.Uint64(page[off:])
 	}
 
-	// TODO: Should throw LoadAccessFault exception
 	return 0
 }
 
 func (mem *Memory) Write(addr, val uint64, size int) {
 	index := addr - dramBase
+	off := index % memPageSize
+	n := uint64(size / 8)
+
+	// access across the page boundary
+	if off+n > memPageSize {
+		for i := uint64(0); i < n; i++ {
+			mem.Write(addr+i, val>>(i*8), byt)
+		}
+		return
+	}
+
+	page := mem.pages[index/memPageSize]
+	if page == nil {
+		page = &[memPageSize]uint8{}
+		mem.pages[index/memPageSize] = page
+	}
+
 	switch size {
 	case byt:
-		mem.Mem[index] = uint8(val)
+		page[off] = uint8(val)
 	case halfword:
-		mem.Mem[index] = uint8(val & 0b1111_1111)
-		mem.Mem[index+1] = uint8((val >> 8) & 0b1111_1111)
+		binary.LittleEndian.PutUint16(page[off:], uint16(val))
 	case word:
-		mem.Mem[index] = uint8(val & 0b1111_1111)
-		mem.Mem[index+1] = uint8((val >> 8) & 0b1111_1111)
-		mem.Mem[index+2] = uint8((val >> 16) & 0b1111_1111)
-		mem.Mem[index+3] = uint8((val >> 24) & 0b1111_1111)
+		binary.LittleEndian.PutUint32(page[off:], uint32(val))
 	case doubleword:
-		mem.Mem[index] = uint8(val & 0b1111_1111)
-		mem.Mem[index+1] = uint8((val >> 8) & 0b1111_1111)
-		mem.Mem[index+2] = uint8((val >> 16) & 0b1111_1111)
-		mem.Mem[index+3] = uint8((val >> 24) & 0b1111_1111)
-		mem.Mem[index+4] = uint8((val >> 32) & 0b1111_1111)
-		mem.Mem[index+5] = uint8((val >> 40) & 0b1111_1111)
-		mem.Mem[index+6] = uint8((val >> 48) & 0b1111_1111)
-		mem.Mem[index+7] = uint8((val >> 56) & 0b1111_1111)
+		binary.LittleEndian.PutUint64(page[off:], val)
+	}
+}
+
+// ReadBytes copies the memory from addr to b.
+func (mem *Memory) ReadBytes(addr uint64, b []byte) {
+	for len(b) > 0 {
+		index := addr - dramBase
+		off := index % memPageSize
+		n := uint64(len(b))
+		if n > memPageSize-off {
+			n = memPageSize - off
+		}
+
+		if page := mem.pages[index/memPageSize]; page != nil {
+			copy(b[:n], page[off:])
+		} else {
+			for i := range b[:n] {
+				b[i] = 0
+			}
+		}
+		addr += n
+		b = b[n:]
+	}
+}
+
+// WriteBytes copies b to the memory from addr.
+func (mem *Memory) WriteBytes(addr uint64, b []byte) {
+	for len(b) > 0 {
+		index := addr - dramBase
+		off := index % memPageSize
+		n := uint64(len(b))
+		if n > memPageSize-off {
+			n = memPageSize - off
+		}
+
+		page := mem.pages[index/memPageSize]
+		if page == nil {
+			page = &[memPageSize]uint8{}
+			mem.pages[index/memPageSize] = page
+		}
+		copy(page[off:], b[:n])
+		addr += n
+		b = b[n:]
+	}
+}
+
+// read, write and tick implement Device. The offset is from dramBase.
+func (mem *Memory) read(offset uint64, size int) (uint64, bool) {
+	return mem.Read(dramBase+offset, size), true
+}
+
+func (mem *Memory) write(offset, val uint64, size int) bool {
+	mem.Write(dramBase+offset, val, size)
+	return true
+}
+
+func (mem *Memory) tick() {}
+
+// parseMemorySize parses the memory size like "512M" or "2G". The unit is MiB if no suffix is given.
+func parseMemorySize(s string) (uint64, error) {
+	units := map[string]uint64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+
+	num, unit := s, uint64(1<<20)
+	if s != "" {
+		if u, ok := units[s[len(s)-1:]]; ok {
+			num, unit = s[:len(s)-1], u
+		}
+	}
+
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size: %s", s)
+	}
+
+	// up to 64GiB
+	size := n * unit
+	if n == 0 || n > (64<<30)/unit || size%memPageSize != 0 {
+		return 0, fmt.Errorf("invalid memory size: %s", s)
 	}
+
+	return size, nil
 }
+
+// reset keeps the content, as the memory is not cleared on reset.
+func (mem *Memory) reset() {}
@@ -1,99 +1,189 @@
 package main
 
+// PLIC (platform-level interrupt controller) compatible with SiFive's one.
+// It is located at 0x0c00_0000. Context 0 is M-mode and context 1 is S-mode of the hart.
 const (
+	plicBase     = 0x0c00_0000
+	plicSize     = 0x0400_0000
+	plicPriority = 0x0
+	plicPending  = 0x1000
+	plicEnable   = 0x2000   // + 0x80 * context
+	plicContext  = 0x200000 // + 0x1000 * context. threshold at +0, claim/complete at +4
+
+	plicSources     = 1024 // source 0 is reserved
+	plicContexts    = 2
+	plicMaxPriority = 7
+
+	mipSeip = 1 << supervisorExternalIntr
+	mipMeip = 1 << machineExternalIntr
+
 	virtioIrq = 1
 	uartIrq   = 10
 )
 
 type Plic struct {
-	clock          uint64
-	irq            uint32
-	enabled        uint64
-	threshold      uint32
-	ips            [1024]uint8
-	priorities     [1024]uint32
-	needsUpdateIrq bool
-	virtioIpCache  bool
+	priorities [plicSources]uint32
+	pending    [plicSources / 32]uint32
+	enabled    [plicContexts][plicSources / 32]uint32
+	thresholds [plicContexts]uint32
+
+	// levels is the interrupt line from each source.
+	levels [plicSources]bool
+	// claimed is true while the interrupt is claimed and not completed yet.
+	// The gateway does not forward the source during that.
+	claimed [plicSources]bool
+
+	// seiOut is the interrupt output to S-mode. It is not written to mip.SEIP, which M-mode
+	// can write, but ORed into it on read.
+	seiOut bool
+
+	mip *uint64
 }
 
-func NewPlic() *Plic {
-	return &Plic{
-		clock:          0,
-		irq:            0,
-		enabled:        0,
-		threshold:      0,
-		ips:            [1024]uint8{},
-		priorities:     [1024]uint32{},
-		needsUpdateIrq: false,
-		virtioIpCache:  false,
-	}
+func NewPlic(mip *uint64) *Plic {
+	return &Plic{mip: mip}
 }
 
-func (p *Plic) tick(virtioIp bool, uartIp bool, mip *uint64) {
-	p.clock++
-	if p.virtioIpCache != virtioIp {
-		if virtioIp {
-			p.setIp(virtioIrq)
-		}
-		p.virtioIpCache = virtioIp
+// reset clears the registers. The interrupt levels are kept as they are driven by the sources.
+func (p *Plic) reset() {
+	*p = Plic{levels: p.levels, mip: p.mip}
+}
+
+// setIrq sets the level of the interrupt line from the source.
+func (p *Plic) setIrq(irq uint32, level bool) {
+	if irq == 0 || irq >= plicSources {
+		return
 	}
 
-	if uartIp {
-		p.setIp(uartIrq)
+	p.levels[irq] = level
+	p.setPending(irq, level && !p.claimed[irq])
+}
+
+func (p *Plic) setPending(irq uint32, pending bool) {
+	if pending {
+		p.pending[irq/32] |= 1 << (irq % 32)
+	} else {
+		p.pending[irq/32] &^= 1 << (irq % 32)
 	}
+}
 
-	if p.needsUpdateIrq {
-		p.updateIrq(mip)
-		p.needsUpdateIrq = false
+// tick reflects the interrupt state of each context on mip.
+func (p *Plic) tick() {
+	if p.best(0) != 0 {
+		*p.mip |= mipMeip
+	} else {
+		*p.mip &^= mipMeip
 	}
+
+	p.seiOut = p.best(1) != 0
 }
 
-func (p *Plic) updateIrq(mip *uint64) {
-	virtioIp := ((p.ips[virtioIrq>>3] >> (virtioIrq & 7)) & 1) == 1
-	uartIp := ((p.ips[uartIrq>>3] >> (uartIrq & 7)) & 1) == 1
+// seip returns mip.SEIP driven by the PLIC.
+func (p *Plic) seip() uint64 {
+	if p.seiOut {
+		return mipSeip
+	}
+	return 0
+}
 
-	virtioPriority := p.priorities[virtioIrq]
-	uartPriority := p.priorities[uartIrq]
+// best returns the pending and enabled source which has the highest priority over the threshold for the context.
+// Ties are broken by the lowest id. 0 is returned if nothing is found.
+func (p *Plic) best(ctx int) uint32 {
+	var irq, priority uint32 = 0, p.thresholds[ctx]
+	for w := range p.pending {
+		ip := p.pending[w] & p.enabled[ctx][w]
+		for b := uint32(0); ip != 0; b, ip = b+1, ip>>1 {
+			i := uint32(w)*32 + b
+			if ip&1 == 1 && p.priorities[i] > priority {
+				irq, priority = i, p.priorities[i]
+			}
+		}
+	}
 
-	virtioEnabled := ((p.enabled >> virtioIrq) & 1) == 1
-	uartEnabled := ((p.enabled >> uartIrq) & 1) == 1
+	return irq
+}
 
-	ips := []bool{virtioIp, uartIp}
-	enables := []bool{virtioEnabled, uartEnabled}
-	priorities := []uint32{virtioPriority, uartPriority}
-	irqs := []uint32{virtioIrq, uartIrq}
+func (p *Plic) claim(ctx int) uint32 {
+	irq := p.best(ctx)
+	if irq != 0 {
+		p.setPending(irq, false)
+		p.claimed[irq] = true
+	}
 
-	var irq uint32 = 0
-	var priority uint32 = 0
+	return irq
+}
 
-	for i := 0; i < 2; i++ {
-		if ips[i] && enables[i] && priorities[i] > p.threshold && priorities[i] > priority {
-			irq = irqs[i]
-			priority = priorities[i]
-		}
+func (p *Plic) complete(ctx int, irq uint32) {
+	if irq == 0 || irq >= plicSources {
+		return
 	}
 
-	p.irq = irq
-	if p.irq != 0 {
-		*mip |= 0x200
+	// completion for the source not enabled for the context is ignored.
+	if p.enabled[ctx][irq/32]&(1<<(irq%32)) == 0 {
+		return
 	}
-}
 
-func (p *Plic) setIp(irq uint32) {
-	index := irq >> 3
-	p.ips[index] = p.ips[index] | (1 << irq)
-	p.needsUpdateIrq = true
+	p.claimed[irq] = false
+	p.setPending(irq, p.levels[irq])
 }
 
-func (p *Plic) clearIp(irq uint32) {
-	index := irq >> 3
-	p.ips[index] = p.ips[index] & ^(1 << irq)
-	p.needsUpdateIrq = true
-}
+func (p *Plic) read(offset uint64, size int) (uint64, bool) {
+	// registers must be accessed by 32-bit
+	if size != word || offset%4 != 0 {
+		return 0, false
+	}
 
-func (p *Plic) read(addr uint64) uint8 {
-	return 0
+	switch {
+	case plicPriority <= offset && offset < plicPriority+4*plicSources:
+		return uint64(p.priorities[(offset-plicPriority)/4]), true
+	case plicPending <= offset && offset < plicPending+plicSources/8:
+		return uint64(p.pending[(offset-plicPending)/4]), true
+	case plicEnable <= offset && offset < plicEnable+0x80*plicContexts:
+		ctx := (offset - plicEnable) / 0x80
+		i := (offset - plicEnable) % 0x80 / 4
+		return uint64(p.enabled[ctx][i]), true
+	case plicContext <= offset && offset < plicContext+0x1000*plicContexts:
+		ctx := int((offset - plicContext) / 0x1000)
+		switch (offset - plicContext) % 0x1000 {
+		case 0:
+			return uint64(p.thresholds[ctx]), true
+		case 4:
+			return uint64(p.claim(ctx)), true
+		}
+	}
+
+	return 0, true
 }
 
-func (p *Plic) write(addr uint64, value uint8) {
+func (p *Plic) write(offset, val uint64, size int) bool {
+	// registers must be accessed by 32-bit
+	if size != word || offset%4 != 0 {
+		return false
+	}
+
+	value := uint32(val)
+	switch {
+	case plicPriority <= offset && offset < plicPriority+4*plicSources:
+		if offset != plicPriority { // source 0 does not exist
+			p.priorities[(offset-plicPriority)/4] = value & plicMaxPriority
+		}
+	case plicEnable <= offset && offset < plicEnable+0x80*plicContexts:
+		ctx := (offset - plicEnable) / 0x80
+		i := (offset - plicEnable) % 0x80 / 4
+		if i == 0 {
+			value &^= 1 // source 0 does not exist
+		}
+		p.enabled[ctx][i] = value
+	case plicContext <= offset && offset < plicContext+0x1000*plicContexts:
+		ctx := int((offset - plicContext) / 0x1000)
+		switch (offset - plicContext) % 0x1000 {
+		case 0:
+			p.thresholds[ctx] = value & plicMaxPriority
+		case 4:
+			p.complete(ctx, value)
+		}
+	}
+	// pending bits are read-only
+
+	return true
 }
@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestPlic(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+	claim := uint64(plicBase + plicContext + 0x1000 + 4) // S-mode context
+
+	cpu.writeRaw(plicBase+plicPriority+4*uartIrq, 1, word)
+	cpu.writeRaw(plicBase+plicPriority+4*virtioIrq, 2, word)
+	cpu.writeRaw(plicBase+plicEnable+0x80, 1<<uartIrq|1<<virtioIrq, word)
+
+	cpu.plic.setIrq(uartIrq, true)
+	cpu.plic.setIrq(virtioIrq, true)
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip == 0 {
+		t.Fatalf("seip is not set")
+	}
+	if cpu.rcsr(mip)&mipMeip != 0 {
+		t.Fatalf("meip must not be set for the source not enabled in M-mode context")
+	}
+	if got, _ := cpu.readRaw(plicBase+plicPending, word); got != 1<<uartIrq|1<<virtioIrq {
+		t.Fatalf("pending: %#x", got)
+	}
+
+	// higher priority comes first
+	if got, _ := cpu.readRaw(claim, word); got != virtioIrq {
+		t.Fatalf("claim: want %d, got %d", virtioIrq, got)
+	}
+	if got, _ := cpu.readRaw(claim, word); got != uartIrq {
+		t.Fatalf("claim: want %d, got %d", uartIrq, got)
+	}
+	if got, _ := cpu.readRaw(claim, word); got != 0 {
+		t.Fatalf("claim: want 0, got %d", got)
+	}
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip != 0 {
+		t.Fatalf("seip must be cleared after claim")
+	}
+
+	// the source still asserting the line becomes pending again on complete
+	cpu.plic.setIrq(virtioIrq, false)
+	cpu.writeRaw(claim, virtioIrq, word)
+	cpu.writeRaw(claim, uartIrq, word)
+	if got, _ := cpu.readRaw(plicBase+plicPending, word); got != 1<<uartIrq {
+		t.Fatalf("pending: %#x", got)
+	}
+
+	// threshold masks the interrupt
+	cpu.writeRaw(plicBase+plicContext+0x1000, 1, word)
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip != 0 {
+		t.Fatalf("seip must be masked by the threshold")
+	}
+
+	// SEIP written by M-mode is kept apart from the PLIC output.
+	cpu.wcsr(mip, mipSeip)
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip == 0 || cpu.rcsr(sip)&mipSeip == 0 {
+		t.Fatalf("software seip is cleared by the PLIC")
+	}
+	cpu.wcsr(mip, 0)
+	cpu.writeRaw(plicBase+plicContext+0x1000, 0, word)
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip == 0 {
+		t.Fatalf("seip is not set by the PLIC")
+	}
+	// read-modify-write does not latch the PLIC output into the software bit.
+	cpu.xregs[11] = 1 << supervisorSoftwareIntr
+	if excp := cpu.exec(0x3445b573, drambase); excp != nil { // csrrc a0, mip, a1
+		t.Fatal(excp)
+	}
+	if cpu.xregs[10]&mipSeip == 0 {
+		t.Fatalf("csrrc must read the PLIC output: %#x", cpu.xregs[10])
+	}
+	if got, _ := cpu.readRaw(claim, word); got != uartIrq {
+		t.Fatalf("claim: want %d, got %d", uartIrq, got)
+	}
+	cpu.plic.tick()
+	if cpu.rcsr(mip)&mipSeip != 0 {
+		t.Fatalf("seip is latched by csrrc")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+// PMP (physical memory protection) with 64 entries whose granularity is 4 bytes.
+const (
+	pmpEntries = 64
+
+	// pmpcfg fields
+	pmpR     = 1 << 0
+	pmpW     = 1 << 1
+	pmpX     = 1 << 2
+	pmpA     = 3 << 3
+	pmpL     = 1 << 7
+	pmpOff   = 0 << 3
+	pmpTOR   = 1 << 3
+	pmpNA4   = 2 << 3
+	pmpNAPOT = 3 << 3
+
+	// bits 6:5 of each pmpcfg field are reserved.
+	pmpcfgwmask = 0x9f9f9f9f9f9f9f9f
+	// pmpaddr holds bits 55:2 of the address.
+	pmpaddrwmask = 1<<54 - 1
+)
+
+// pmpEntry is a decoded PMP entry which matches [lo, hi).
+type pmpEntry struct {
+	lo, hi uint64
+	cfg    uint8
+}
+
+// pmpcfg returns the configuration of the i-th entry.
+func (cpu *CPU) pmpcfg(i uint64) uint8 {
+	// pmpcfg0 holds the entry 0-7, pmpcfg2 holds the entry 8-15, and so on.
+	return uint8(cpu.csr[pmpcfg0+i/8*2] >> (i % 8 * 8))
+}
+
+// pmpcfgLocked returns the fields of pmpcfg{n} which are locked.
+func (cpu *CPU) pmpcfgLocked(n uint64) uint64 {
+	locked := uint64(0)
+	for i := uint64(0); i < 8; i++ {
+		if cpu.pmpcfg(n*4+i)&pmpL != 0 {
+			locked |= 0xff << (i * 8)
+		}
+	}
+	return locked
+}
+
+// pmpaddrLocked returns true if pmpaddr{i} is locked by its own entry or the next TOR entry.
+func (cpu *CPU) pmpaddrLocked(i uint64) bool {
+	if cpu.pmpcfg(i)&pmpL != 0 {
+		return true
+	}
+
+	return i+1 < pmpEntries && cpu.pmpcfg(i+1)&(pmpL|pmpA) == pmpL|pmpTOR
+}
+
+// legalizePmpcfg keeps the old field if the new one has the reserved R=0 and W=1 combination.
+func legalizePmpcfg(old, val uint64) uint64 {
+	for i := uint64(0); i < 64; i += 8 {
+		if (val>>i)&(pmpR|pmpW) == pmpW {
+			val = val&^(0xff<<i) | old&(0xff<<i)
+		}
+	}
+	return val
+}
+
+// updatePMP decodes the active PMP entries. The TLB is flushed as the cached translations
+// have been checked against the old entries.
+func (cpu *CPU) updatePMP() {
+	cpu.pmp = cpu.pmp[:0]
+	for i := uint64(0); i < pmpEntries; i++ {
+		cfg := cpu.pmpcfg(i)
+		addr := cpu.csr[pmpaddr0+i]
+
+		var lo, hi uint64
+		switch cfg & pmpA {
+		case pmpOff:
+			continue
+		case pmpTOR:
+			if i > 0 {
+				lo = cpu.csr[pmpaddr0+i-1] << 2
+			}
+			hi = addr << 2
+		case pmpNA4:
+			lo, hi = addr<<2, addr<<2+4
+		case pmpNAPOT:
+			// the number of trailing ones encodes the size.
+			size := uint64(8)
+			for addr&1 == 1 {
+				addr >>= 1
+				size <<= 1
+			}
+			lo = (cpu.csr[pmpaddr0+i] << 2) &^ (size - 1)
+			hi = lo + size
+		}
+
+		cpu.pmp = append(cpu.pmp, pmpEntry{lo: lo, hi: hi, cfg: cfg})
+	}
+
+	cpu.tlb.flushAll()
+}
+
+// pmpCheck returns true if the access to [addr, addr+length) in the mode is permitted.
+// The lowest-numbered entry matching any byte decides, and it must match all the bytes.
+func (cpu *CPU) pmpCheck(addr, length uint64, ma int, mode int) bool {
+	end := addr + length
+	for _, e := range cpu.pmp {
+		if end <= e.lo || e.hi <= addr {
+			continue
+		}
+
+		if addr < e.lo || e.hi < end {
+			return false
+		}
+
+		// M-mode is restricted only by locked entries.
+		if mode == machine && e.cfg&pmpL == 0 {
+			return true
+		}
+
+		switch ma {
+		case maInst:
+			return e.cfg&pmpX != 0
+		case maLoad:
+			return e.cfg&pmpR != 0
+		default:
+			return e.cfg&pmpW != 0
+		}
+	}
+
+	// S-mode and U-mode need a matching entry as PMP is implemented.
+	return mode == machine
+}
+
+// dataMode returns the privilege mode of loads and stores, which is MPP if mstatus.MPRV is set in M-mode.
+func (cpu *CPU) dataMode() int {
+	if cpu.mode == machine && bit(cpu.csr[mstatus], 17) == 1 {
+		return int(bits(cpu.csr[mstatus], 12, 11))
+	}
+
+	return cpu.mode
+}
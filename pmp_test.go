@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+// allowAll configures PMP so that S-mode and U-mode can access everything.
+func allowAll(cpu *CPU) {
+	cpu.wcsr(pmpaddr0, all)
+	cpu.wcsr(pmpcfg0, pmpNAPOT|pmpR|pmpW|pmpX)
+}
+
+func TestPMP(t *testing.T) {
+	cpu := NewCPU(defaultRAMSize)
+
+	access := func(mode int, addr uint64, size int, ma int) *trap {
+		t.Helper()
+		cpu.mode = mode
+		if ma == maStore {
+			return cpu.write(addr, 0, size)
+		}
+		_, excp := cpu.read(addr, size)
+		return excp
+	}
+
+	// nothing matches S-mode access without entries
+	if excp := access(supervisor, drambase, word, maLoad); excp == nil || excp.code != loadAccessFault {
+		t.Fatalf("want load access fault, got %+v", excp)
+	}
+	if excp := access(machine, drambase, word, maLoad); excp != nil {
+		t.Fatalf("M-mode access must succeed: %+v", excp)
+	}
+
+	// entry 1: read-only [drambase, drambase+0x1000) by TOR, entry 2: everything by NAPOT
+	cpu.wcsr(pmpaddr0, drambase>>2)
+	cpu.wcsr(pmpaddr0+1, (drambase+0x1000)>>2)
+	cpu.wcsr(pmpaddr0+2, all)
+	cpu.wcsr(pmpcfg0, (pmpNAPOT|pmpR|pmpW|pmpX)<<16|(pmpTOR|pmpR)<<8)
+
+	tests := []struct {
+		name string
+		mode int
+		addr uint64
+		size int
+		ma   int
+		ok   bool
+	}{
+		{"load from read-only", supervisor, drambase, word, maLoad, true},
+		{"store to read-only", supervisor, drambase, word, maStore, false},
+		{"store to another region", user, drambase + 0x1000, word, maStore, true},
+		{"store across the regions", supervisor, drambase + 0xffe, word, maStore, false},
+		{"M-mode store to unlocked entry", machine, drambase, word, maStore, true},
+	}
+
+	for _, tc := range tests {
+		excp := access(tc.mode, tc.addr, tc.size, tc.ma)
+		if tc.ok && excp != nil {
+			t.Errorf("%s: unexpected fault %+v", tc.name, excp)
+		}
+		if !tc.ok && (excp == nil || excp.code != storeAccessFault || excp.value != tc.addr) {
+			t.Errorf("%s: want store access fault, got %+v", tc.name, excp)
+		}
+	}
+
+	// MPRV applies PMP as S-mode
+	cpu.wcsr(mstatus, 1<<17|1<<11)
+	if excp := access(machine, drambase, word, maStore); excp == nil || excp.code != storeAccessFault {
+		t.Fatalf("want store access fault with MPRV, got %+v", excp)
+	}
+	cpu.wcsr(mstatus, 0)
+
+	// locked entry applies to M-mode and cannot be changed
+	cpu.wcsr(pmpcfg0, cpu.rcsr(pmpcfg0)|pmpL<<8)
+	if excp := access(machine, drambase, word, maStore); excp == nil || excp.code != storeAccessFault {
+		t.Fatalf("want store access fault for locked entry, got %+v", excp)
+	}
+
+	cfg := cpu.rcsr(pmpcfg0)
+	cpu.wcsr(pmpcfg0, 0)
+	if got := cpu.rcsr(pmpcfg0); got != cfg&0xff00 {
+		t.Errorf("pmpcfg0: want %#x, got %#x", cfg&0xff00, got)
+	}
+	// pmpaddr0 is the bottom of the locked TOR entry.
+	for _, addr := range []uint64{pmpaddr0, pmpaddr0 + 1} {
+		old := cpu.rcsr(addr)
+		cpu.wcsr(addr, 0)
+		if got := cpu.rcsr(addr); got != old {
+			t.Errorf("pmpaddr%d: want %#x, got %#x", addr-pmpaddr0, old, got)
+		}
+	}
+
+	// R=0 and W=1 is reserved
+	cpu.wcsr(pmpcfg0+2, pmpNA4|pmpW)
+	if got := cpu.rcsr(pmpcfg0 + 2); got != 0 {
+		t.Errorf("pmpcfg2: want 0, got %#x", got)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+// TLB caches the leaf PTEs found by the page table walk.
+// A superpage is cached per 4KiB page, and each entry remembers the size of the original page for sfence.vma.
+// Permissions are checked on every hit against the current privilege mode and mstatus,
+// so the TLB does not need to be flushed on mode changes or MPRV/SUM/MXR updates.
+const (
+	tlbSets = 256
+	tlbWays = 4
+)
+
+type tlbEntry struct {
+	valid bool
+	vpn   uint64 // virtual page number of the 4KiB page
+	asid  uint64
+	ppn   uint64 // physical page number of the 4KiB page
+	mask  uint64 // VPN bits which are in the same (super)page
+	pte   uint64 // leaf PTE, whose flags are used for the permission check
+}
+
+type tlb struct {
+	sets [tlbSets][tlbWays]tlbEntry
+	next [tlbSets]int // round-robin replacement
+}
+
+func (e *tlbEntry) match(vpn, asid uint64) bool {
+	return e.valid && e.vpn == vpn && (e.asid == asid || e.pte&pteG != 0)
+}
+
+// lookup returns the entry for the virtual page number, or nil if it is not cached.
+func (t *tlb) lookup(vpn, asid uint64) *tlbEntry {
+	set := &t.sets[vpn%tlbSets]
+	for i := range set {
+		if set[i].match(vpn, asid) {
+			return &set[i]
+		}
+	}
+
+	return nil
+}
+
+// insert caches the entry, replacing the existing one for the same page.
+func (t *tlb) insert(e tlbEntry) {
+	e.valid = true
+	i := e.vpn % tlbSets
+	if old := t.lookup(e.vpn, e.asid); old != nil {
+		*old = e
+		return
+	}
+
+	t.sets[i][t.next[i]] = e
+	t.next[i] = (t.next[i] + 1) % tlbWays
+}
+
+// flush invalidates the entries as sfence.vma does. If byAddr is false, entries for every address are invalidated.
+// If byASID is false, entries for every address space are invalidated, otherwise global entries are kept.
+func (t *tlb) flush(vpn uint64, byAddr bool, asid uint64, byASID bool) {
+	for i := range t.sets {
+		for j := range t.sets[i] {
+			e := &t.sets[i][j]
+			if byAddr && (e.vpn^vpn)&^e.mask != 0 {
+				continue
+			}
+			if byASID && (e.asid != asid || e.pte&pteG != 0) {
+				continue
+			}
+			e.valid = false
+		}
+	}
+}
+
+func (t *tlb) flushAll() {
+	t.flush(0, false, 0, false)
+}
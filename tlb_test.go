@@ -0,0 +1,173 @@
+package main
+
+import "testing"
+
+func TestTLB(t *testing.T) {
+	const (
+		root = drambase + 0x10000
+		va   = 0x4000_1000 // in the second 1GiB
+	)
+
+	cpu := NewCPU(defaultRAMSize)
+	allowAll(cpu)
+	// 1GiB superpage at va, mapped to drambase
+	leaf := uint64(root + ((va>>30)&0x1ff)*8)
+	cpu.ram.Write(leaf, (drambase>>12)<<10|pteA|pteR|pteW|pteV, doubleword)
+	cpu.wcsr(satp, 8<<60|1<<44|root>>12) // ASID 1
+	cpu.mode = supervisor
+
+	translate := func(addr uint64, ma int) uint64 {
+		t.Helper()
+		pa, excp := cpu.translate(addr, ma)
+		if excp != nil {
+			t.Fatalf("translate %#x: %+v", addr, excp)
+		}
+		return pa
+	}
+
+	if got := translate(va, maLoad); got != drambase+0x1000 {
+		t.Fatalf("want %#x, got %#x", drambase+0x1000, got)
+	}
+
+	// store walks the page table again to set D bit
+	translate(va, maStore)
+	if cpu.ram.Read(leaf, doubleword)&pteD == 0 {
+		t.Fatalf("D bit is not set")
+	}
+
+	// the stale translation is used until sfence.vma
+	cpu.ram.Write(leaf, (drambase>>12+0x40000)<<10|pteD|pteA|pteR|pteW|pteV, doubleword)
+	if got := translate(va, maLoad); got != drambase+0x1000 {
+		t.Fatalf("translation is not cached: %#x", got)
+	}
+
+	// flushing another ASID does nothing
+	cpu.tlb.flush(0, false, 2, true)
+	if got := translate(va, maLoad); got != drambase+0x1000 {
+		t.Fatalf("translation for ASID 1 is flushed: %#x", got)
+	}
+
+	// flushing another 4KiB page in the same superpage invalidates the entry
+	cpu.tlb.flush((va+0x20_0000)>>12, true, 0, false)
+	if got := translate(va, maLoad); got != drambase+0x4000_1000 {
+		t.Fatalf("translation is not flushed: %#x", got)
+	}
+
+	// changing the mode flushes everything
+	cpu.wcsr(satp, 0)
+	cpu.wcsr(satp, 9<<60|1<<44|root>>12)
+	if e := cpu.tlb.lookup(va>>12, 1); e != nil {
+		t.Fatalf("entry survives the mode change: %+v", e)
+	}
+}
+
+func TestSfenceVMA(t *testing.T) {
+	const (
+		root = drambase + 0x10000
+		va1  = 0x4000_0000 // ASID 1
+		va2  = 0x8000_0000 // ASID 1
+		vag  = 0xc000_0000 // global
+	)
+	vas := []uint64{va1, va2, vag}
+
+	tests := []struct {
+		name  string
+		inst  uint64
+		a0    uint64
+		a1    uint64
+		fresh []bool // whether the translations of va1, va2 and vag are flushed
+	}{
+		{"all", 0x12000073, va1, 2, []bool{true, true, true}},
+		{"by address", 0x12050073, va1 + 0x1234, 2, []bool{true, false, false}},
+		{"global by address", 0x12050073, vag, 2, []bool{false, false, true}},
+		{"by ASID", 0x12b00073, va1, 1, []bool{true, true, false}},
+		{"by another ASID", 0x12b00073, va1, 2, []bool{false, false, false}},
+		{"by address and ASID", 0x12b50073, va2, 1, []bool{false, true, false}},
+		{"by address and another ASID", 0x12b50073, va2, 2, []bool{false, false, false}},
+		{"global by address and ASID", 0x12b50073, vag, 1, []bool{false, false, false}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu := NewCPU(defaultRAMSize)
+			allowAll(cpu)
+			cpu.wcsr(satp, 8<<60|1<<44|root>>12) // ASID 1
+			cpu.mode = supervisor
+
+			// 1GiB superpages mapped to drambase, then remapped to 0xc000_0000 behind the TLB
+			mapAll := func(pa uint64) {
+				for _, va := range vas {
+					pte := (pa>>12)<<10 | pteD | pteA | pteR | pteW | pteV
+					if va == vag {
+						pte |= pteG
+					}
+					cpu.ram.Write(root+(va>>30)*8, pte, doubleword)
+				}
+			}
+			mapAll(drambase)
+			for _, va := range vas {
+				if _, excp := cpu.translate(va, maLoad); excp != nil {
+					t.Fatalf("translate %#x: %+v", va, excp)
+				}
+			}
+			mapAll(0xc000_0000)
+
+			cpu.xregs[10], cpu.xregs[11] = tc.a0, tc.a1
+			if excp := cpu.exec(tc.inst, drambase); excp != nil {
+				t.Fatalf("sfence.vma: %+v", excp)
+			}
+
+			for i, va := range vas {
+				want := uint64(drambase + 0x10)
+				if tc.fresh[i] {
+					want = 0xc000_0010
+				}
+				pa, excp := cpu.translate(va+0x10, maLoad)
+				if excp != nil {
+					t.Fatalf("translate %#x: %+v", va, excp)
+				}
+				if pa != want {
+					t.Errorf("%#x: want %#x, got %#x", va, want, pa)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTranslate(b *testing.B) {
+	const (
+		root = drambase + 0x10000
+		va   = 0x12_3456_7000
+	)
+
+	// Sv39 with 4KiB pages
+	cpu := NewCPU(defaultRAMSize)
+	allowAll(cpu)
+	table := uint64(root)
+	for l := 2; l > 0; l-- {
+		next := table + 0x1000
+		cpu.ram.Write(table+((va>>(12+9*l))&0x1ff)*8, (next>>12)<<10|pteV, doubleword)
+		table = next
+	}
+	cpu.ram.Write(table+((va>>12)&0x1ff)*8, (drambase+0x5000)>>12<<10|pteD|pteA|pteR|pteW|pteV, doubleword)
+	cpu.wcsr(satp, 8<<60|root>>12)
+	cpu.mode = supervisor
+
+	b.Run("hit", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, excp := cpu.translate(va+uint64(i%512)*8, maLoad); excp != nil {
+				b.Fatal(excp)
+			}
+		}
+	})
+
+	// walks the page table every time, including the cost of flushing the TLB.
+	b.Run("miss", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cpu.tlb.flushAll()
+			if _, excp := cpu.translate(va+uint64(i%512)*8, maLoad); excp != nil {
+				b.Fatal(excp)
+			}
+		}
+	})
+}
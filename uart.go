@@ -1,182 +1,503 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 )
 
+// NS16550A UART with 16-byte FIFOs. It is located at 0x1000_0000.
 const (
-	ierRxintBit   = 0x1
-	ierThreintBit = 0x2
+	uartBase = 0x1000_0000
+	uartSize = 0x100
 
-	iirThrEmpty    = 0x2
-	iirRdAvailable = 0x4
-	iirNoInterrupt = 0x7
+	// register offsets
+	uartRBR = 0 // receiver buffer (read, DLAB=0)
+	uartTHR = 0 // transmitter holding (write, DLAB=0)
+	uartDLL = 0 // divisor latch LSB (DLAB=1)
+	uartIER = 1 // interrupt enable (DLAB=0)
+	uartDLM = 1 // divisor latch MSB (DLAB=1)
+	uartIIR = 2 // interrupt identification (read)
+	uartFCR = 2 // FIFO control (write)
+	uartLCR = 3 // line control
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
 
-	lsrDataAvailable = 0x1
-	lsrThrEmpty      = 0x20
+	// IER
+	ierRDA  = 0x1 // received data available
+	ierTHRE = 0x2 // THR empty
+	ierRLS  = 0x4 // receiver line status
+	ierMS   = 0x8 // modem status
+
+	// IIR, in priority order
+	iirNoInterrupt = 0x1
+	iirRLS         = 0x6
+	iirRDA         = 0x4
+	iirTimeout     = 0xc
+	iirTHRE        = 0x2
+	iirMS          = 0x0
+	iirFIFOEnabled = 0xc0
+
+	// FCR
+	fcrEnable  = 0x1
+	fcrClearRx = 0x2
+	fcrClearTx = 0x4
+	fcrDMA     = 0x8
+
+	// LCR
+	lcrDLAB = 0x80
+
+	// MCR
+	mcrDTR      = 0x1
+	mcrRTS      = 0x2
+	mcrOut1     = 0x4
+	mcrOut2     = 0x8
+	mcrLoopback = 0x10
+
+	// LSR
+	lsrDR     = 0x1  // data ready
+	lsrOE     = 0x2  // overrun error
+	lsrPE     = 0x4  // parity error
+	lsrFE     = 0x8  // framing error
+	lsrBI     = 0x10 // break interrupt
+	lsrTHRE   = 0x20 // THR (and the TX FIFO) empty
+	lsrTEMT   = 0x40 // transmitter empty
+	lsrErrors = lsrOE | lsrPE | lsrFE | lsrBI
+
+	// MSR
+	msrDCTS  = 0x1
+	msrDDSR  = 0x2
+	msrTERI  = 0x4
+	msrDDCD  = 0x8
+	msrCTS   = 0x10
+	msrDSR   = 0x20
+	msrRI    = 0x40
+	msrDCD   = 0x80
+	msrDelta = msrDCTS | msrDDSR | msrTERI | msrDDCD
+
+	uartFIFOSize = 16
+	// uartCharTicks is the number of ticks to send or receive a character.
+	uartCharTicks = 0x10
+	// the character timeout is raised after no RX FIFO activity for 4 character times.
+	uartTimeoutChars = 4
 )
 
+// uartTriggerLevels is the RX FIFO trigger level selected by FCR bits 7:6.
+var uartTriggerLevels = [4]int{1, 4, 8, 14}
+
+// fifo is the RX or TX FIFO of the UART.
+type fifo struct {
+	buf  [uartFIFOSize]byte
+	head int
+	len  int
+}
+
+func (f *fifo) push(b byte) {
+	f.buf[(f.head+f.len)%uartFIFOSize] = b
+	f.len++
+}
+
+func (f *fifo) pop() byte {
+	b := f.buf[f.head]
+	f.head = (f.head + 1) % uartFIFOSize
+	f.len--
+	return b
+}
+
+func (f *fifo) clear() {
+	f.head, f.len = 0, 0
+}
+
 type Uart struct {
-	clock        uint64
-	rbr          uint8 // receiver buffer register
-	thr          uint8 // transmitter holding register
-	ier          uint8 // interrupt enable register
-	iir          uint8 // interrupt identification register
-	lcr          uint8 // line control register
-	mcr          uint8 // modem control register
-	lsr          uint8 // line status register
-	scr          uint8 // scratch,
-	threip       bool
-	interrupting bool
+	clock uint64
+
+	rbr uint8 // the last received byte
+	ier uint8
+	fcr uint8
+	lcr uint8
+	mcr uint8
+	lsr uint8 // only the error bits, the others are derived from the FIFOs
+	msr uint8
+	scr uint8
+	dll uint8
+	dlm uint8
+
+	rx, tx fifo
+	tsr    uint8 // transmitter shift register
+	txBusy bool  // tsr has a byte being sent
+	rxIdle int   // character times since the last RX FIFO activity
+	thri   bool  // THR empty interrupt is pending
 
 	sync.Mutex
-	buffer []byte
+	buffer []byte // input from the host
+
+	out io.Writer // output to the host
+
+	irq   func(level bool)
+	level bool
 }
 
-func NewUart() *Uart {
+// NewUart returns the UART connected to the host console. in can be nil if there is no input.
+func NewUart(in io.Reader, out io.Writer, irq func(level bool)) *Uart {
 	u := &Uart{
-		clock:        0,
-		rbr:          0,
-		thr:          0,
-		ier:          0,
-		iir:          0,
-		lcr:          0,
-		mcr:          0,
-		lsr:          lsrThrEmpty,
-		scr:          0,
-		threip:       false,
-		interrupting: false,
-
-		buffer: []byte{}, // stdin buffer
-	}
-	// read input
+		buffer: []byte{},
+		irq:    irq,
+	}
+	u.reset()
+	u.attach(in, out)
+
+	return u
+}
+
+// attach connects the UART to the host console. It must be called before the emulation starts.
+// The input is read until EOF in the background.
+func (u *Uart) attach(in io.Reader, out io.Writer) {
+	if out == nil {
+		out = io.Discard
+	}
+	u.out = out
+
+	if in == nil {
+		return
+	}
+
 	go func() {
-		r := bufio.NewReader(os.Stdin)
+		buf := make([]byte, 256)
 		for {
-			b, err := r.ReadByte()
+			n, err := in.Read(buf)
+			if n > 0 {
+				u.Lock()
+				u.buffer = append(u.buffer, buf[:n]...)
+				u.Unlock()
+			}
+
 			if err != nil {
-				if err == io.EOF {
-					continue
+				if !errors.Is(err, io.EOF) {
+					fmt.Fprintf(os.Stderr, "read console: %s\n", err)
 				}
-				fmt.Fprintf(os.Stderr, "read stdin: %s", err)
-				continue
+				return
 			}
-
-			u.Lock()
-			u.buffer = append(u.buffer, b)
-			u.Unlock()
 		}
 	}()
-
-	return u
 }
 
-func (u *Uart) Tick() {
+// tick advances the transmitter and the receiver by a character on each character time.
+func (u *Uart) tick() {
 	u.clock++
-	rxip := false
-
-	// read input and store into register
-	if u.clock%0x38400 == 0 && u.rbr == 0 {
-		// get single byte
-		u.Lock()
-		b := u.buffer[0]
-		u.buffer = u.buffer[1:]
-		u.Unlock()
-
-		if b != 0 {
-			u.rbr = b
-			u.lsr |= lsrDataAvailable
-			u.updateIir()
-			if u.ier&ierRxintBit != 0 {
-				rxip = true
-			}
+	if u.clock%uartCharTicks != 0 {
+		return
+	}
+
+	if u.rx.len > 0 && u.rxIdle < uartTimeoutChars {
+		u.rxIdle++
+	}
+
+	// the byte in the shift register has been sent, and the next one is moved from the TX FIFO.
+	if u.txBusy {
+		u.txBusy = false
+		if u.mcr&mcrLoopback != 0 {
+			u.receive(u.tsr)
+		} else {
+			u.out.Write([]byte{u.tsr})
+		}
+	}
+	if u.tx.len > 0 {
+		u.tsr = u.tx.pop()
+		u.txBusy = true
+		if u.tx.len == 0 {
+			u.thri = true
+		}
+	}
+
+	// the host input is not received in loopback mode, and it waits while the RX FIFO is full.
+	if u.mcr&mcrLoopback == 0 && u.rx.len < u.fifoSize() {
+		if b, ok := u.readInput(); ok {
+			u.receive(b)
+		}
+	}
+
+	u.updateIrq()
+}
+
+// reset clears the registers and the FIFOs. The input from the host is kept.
+func (u *Uart) reset() {
+	u.clock = 0
+	u.rbr = 0
+	u.ier = 0
+	u.fcr = 0
+	u.lcr = 0
+	u.mcr = 0
+	u.lsr = 0
+	u.msr = 0
+	u.scr = 0
+	u.dll = 0
+	u.dlm = 0
+	u.clearRx()
+	u.tx.clear()
+	u.txBusy = false
+	u.thri = false
+	u.updateMsr()
+	u.msr &^= msrDelta
+	u.updateIrq()
+}
+
+// readInput returns a byte from the host input if any.
+func (u *Uart) readInput() (byte, bool) {
+	u.Lock()
+	defer u.Unlock()
+
+	if len(u.buffer) == 0 {
+		return 0, false
+	}
+
+	b := u.buffer[0]
+	u.buffer = u.buffer[1:]
+	return b, true
+}
+
+// fifoSize returns the size of the FIFOs, which is 1 (just the holding registers) if FIFOs are disabled.
+func (u *Uart) fifoSize() int {
+	if u.fcr&fcrEnable == 0 {
+		return 1
+	}
+	return uartFIFOSize
+}
+
+// receive puts the byte into the RX FIFO. The byte is lost with the overrun error if the FIFO is full.
+func (u *Uart) receive(b byte) {
+	if u.rx.len >= u.fifoSize() {
+		u.lsr |= lsrOE
+		return
+	}
+
+	u.rx.push(b)
+	u.rxIdle = 0
+}
+
+func (u *Uart) clearRx() {
+	u.rx.clear()
+	u.rxIdle = 0
+}
+
+// clearTx clears the TX FIFO. The byte in the shift register is still sent.
+func (u *Uart) clearTx() {
+	if u.tx.len > 0 {
+		u.thri = true
+	}
+	u.tx.clear()
+}
+
+// lineStatus returns LSR.
+func (u *Uart) lineStatus() uint8 {
+	lsr := u.lsr
+	if u.rx.len > 0 {
+		lsr |= lsrDR
+	}
+	if u.tx.len == 0 {
+		lsr |= lsrTHRE
+		if !u.txBusy {
+			lsr |= lsrTEMT
 		}
 	}
+	return lsr
+}
 
-	// write reg value to stdout
-	if u.clock%0x10 == 0 && u.thr != 0 {
-		fmt.Fprint(os.Stdout, string(u.thr))
-		u.thr = 0
-		u.lsr |= lsrThrEmpty
-		u.updateIir()
-		if u.ier&ierThreintBit != 0 {
-			u.threip = true
+// iir returns the highest priority interrupt.
+func (u *Uart) iir() uint8 {
+	iir := uint8(iirNoInterrupt)
+	switch {
+	case u.ier&ierRLS != 0 && u.lsr&lsrErrors != 0:
+		iir = iirRLS
+	case u.ier&ierRDA != 0 && u.rxReady():
+		iir = iirRDA
+	case u.ier&ierRDA != 0 && u.rxTimeout():
+		iir = iirTimeout
+	case u.ier&ierTHRE != 0 && u.thri:
+		iir = iirTHRE
+	case u.ier&ierMS != 0 && u.msr&msrDelta != 0:
+		iir = iirMS
+	}
+
+	if u.fcr&fcrEnable != 0 {
+		iir |= iirFIFOEnabled
+	}
+	return iir
+}
+
+// rxReady returns true if the RX FIFO has reached the trigger level.
+func (u *Uart) rxReady() bool {
+	if u.fcr&fcrEnable == 0 {
+		return u.rx.len > 0
+	}
+	return u.rx.len >= uartTriggerLevels[u.fcr>>6]
+}
+
+// rxTimeout returns true if the RX FIFO has bytes below the trigger level and no activity for a while.
+func (u *Uart) rxTimeout() bool {
+	return u.fcr&fcrEnable != 0 && u.rx.len > 0 && u.rxIdle >= uartTimeoutChars
+}
+
+func (u *Uart) updateIrq() {
+	level := u.iir()&iirNoInterrupt == 0
+	if level != u.level {
+		u.level = level
+		u.irq(level)
+	}
+}
+
+// updateMsr updates the modem status, which is looped back from MCR in loopback mode.
+// Otherwise CTS, DSR and DCD are always asserted as the host is always ready.
+func (u *Uart) updateMsr() {
+	status := uint8(msrCTS | msrDSR | msrDCD)
+	if u.mcr&mcrLoopback != 0 {
+		status = 0
+		if u.mcr&mcrRTS != 0 {
+			status |= msrCTS
+		}
+		if u.mcr&mcrDTR != 0 {
+			status |= msrDSR
+		}
+		if u.mcr&mcrOut1 != 0 {
+			status |= msrRI
+		}
+		if u.mcr&mcrOut2 != 0 {
+			status |= msrDCD
 		}
 	}
 
-	if u.threip || rxip {
-		u.interrupting = true
-		u.threip = false
-	} else {
-		u.interrupting = false
+	changed := u.msr ^ status
+	delta := u.msr & msrDelta
+	if changed&msrCTS != 0 {
+		delta |= msrDCTS
+	}
+	if changed&msrDSR != 0 {
+		delta |= msrDDSR
 	}
+	if changed&msrRI != 0 && status&msrRI == 0 {
+		// trailing edge of RI
+		delta |= msrTERI
+	}
+	if changed&msrDCD != 0 {
+		delta |= msrDDCD
+	}
+	u.msr = status | delta
 }
 
-func (u *Uart) updateIir() {
-	rxip := u.ier&ierRxintBit != 0 && u.rbr != 0
-	threip := u.ier&ierThreintBit != 0 && u.thr == 0
+func (u *Uart) read(offset uint64, size int) (uint64, bool) {
+	// registers must be accessed by byte
+	if size != byt {
+		return 0, false
+	}
 
-	if rxip {
-		u.iir = iirRdAvailable
-	} else if threip {
-		u.iir = iirThrEmpty
-	} else {
-		u.iir = iirNoInterrupt
+	v := u.readReg(offset)
+	u.updateIrq()
+	return uint64(v), true
+}
+
+func (u *Uart) write(offset, val uint64, size int) bool {
+	// registers must be accessed by byte
+	if size != byt {
+		return false
 	}
+
+	u.writeReg(offset, uint8(val))
+	u.updateIrq()
+	return true
 }
 
-func (u *Uart) read(address uint64) uint8 {
-	switch address {
-	case 0x10000000:
-		if (u.lcr >> 7) == 0 {
-			rbr := u.rbr
-			u.rbr = 0
-			u.lsr &= ^uint8(lsrDataAvailable)
-			u.updateIir()
-			return rbr
+func (u *Uart) readReg(offset uint64) uint8 {
+	dlab := u.lcr&lcrDLAB != 0
+
+	switch offset {
+	case uartRBR:
+		if dlab {
+			return u.dll
+		}
+		if u.rx.len > 0 {
+			u.rbr = u.rx.pop()
+			u.rxIdle = 0
+		}
+		return u.rbr
+	case uartIER:
+		if dlab {
+			return u.dlm
 		}
-	case 0x10000001:
-		if (u.lcr >> 7) == 0 {
-			return u.ier
+		return u.ier
+	case uartIIR:
+		iir := u.iir()
+		// reading IIR clears the THR empty interrupt if it is the reported one.
+		if iir&0xf == iirTHRE {
+			u.thri = false
 		}
-	case 0x10000002:
-		return u.iir
-	case 0x10000003:
+		return iir
+	case uartLCR:
 		return u.lcr
-	case 0x10000004:
+	case uartMCR:
 		return u.mcr
-	case 0x10000005:
-		return u.lsr
-	case 0x10000007:
+	case uartLSR:
+		lsr := u.lineStatus()
+		u.lsr &^= lsrErrors
+		return lsr
+	case uartMSR:
+		msr := u.msr
+		u.msr &^= msrDelta
+		return msr
+	case uartSCR:
 		return u.scr
 	}
 	return 0
 }
 
-func (u *Uart) write(address uint64, value uint8) {
-	switch address {
-	case 0x10000000:
-		if (u.lcr >> 7) == 0 {
-			u.thr = value
-			u.lsr &= ^uint8(lsrThrEmpty)
-			u.updateIir()
+func (u *Uart) writeReg(offset uint64, value uint8) {
+	dlab := u.lcr&lcrDLAB != 0
+
+	switch offset {
+	case uartTHR:
+		if dlab {
+			u.dll = value
+			return
+		}
+		// the byte is lost if the TX FIFO is full.
+		if u.tx.len < u.fifoSize() {
+			u.tx.push(value)
+		}
+		u.thri = false
+	case uartIER:
+		if dlab {
+			u.dlm = value
+			return
 		}
-	case 0x10000001:
-		if u.ier&ierThreintBit == 0 && value&ierThreintBit != 0 && u.thr == 0 {
-			u.threip = true
+		// enabling the THR empty interrupt raises it immediately if THR is empty.
+		if u.ier&ierTHRE == 0 && value&ierTHRE != 0 && u.tx.len == 0 {
+			u.thri = true
+		}
+		u.ier = value & 0xf
+	case uartFCR:
+		// changing the FIFO enable clears the FIFOs.
+		toggled := (u.fcr^value)&fcrEnable != 0
+		if toggled || value&fcrClearRx != 0 {
+			u.clearRx()
+		}
+		if toggled || value&fcrClearTx != 0 {
+			u.clearTx()
 		}
 
-		u.ier = value
-		u.updateIir()
-	case 0x10000003:
+		// the other bits can be written only with the FIFO enable.
+		if value&fcrEnable == 0 {
+			u.fcr = 0
+			return
+		}
+		u.fcr = value & (fcrEnable | fcrDMA | 0xc0)
+	case uartLCR:
 		u.lcr = value
-	case 0x10000004:
-		u.mcr = value
-	case 0x10000007:
+	case uartMCR:
+		u.mcr = value & 0x1f
+		u.updateMsr()
+	case uartSCR:
 		u.scr = value
 	}
 }
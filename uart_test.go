@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUart(t *testing.T) {
+	var out bytes.Buffer
+	irq := false
+	u := NewUart(strings.NewReader("hi"), &out, func(level bool) { irq = level })
+	u.write(uartIER, ierRDA, byt)
+
+	// the input is read in the background
+	for deadline := time.Now().Add(time.Second); u.lineStatus()&lsrDR == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("input is not received")
+		}
+		u.tick()
+	}
+	if !irq {
+		t.Fatal("receive interrupt is not raised")
+	}
+	if got, _ := u.read(uartRBR, byt); got != 'h' {
+		t.Fatalf("rbr: want 'h', got %#x", got)
+	}
+
+	for _, b := range []byte("ok") {
+		u.write(uartTHR, uint64(b), byt)
+		for u.lineStatus()&lsrTEMT == 0 {
+			u.tick()
+		}
+	}
+	if out.String() != "ok" {
+		t.Fatalf("output: want \"ok\", got %q", out.String())
+	}
+}
+
+func TestUartFIFO(t *testing.T) {
+	var out bytes.Buffer
+	irq := false
+	u := NewUart(nil, &out, func(level bool) { irq = level })
+
+	reg := func(offset uint64) uint8 {
+		v, _ := u.read(offset, byt)
+		return uint8(v)
+	}
+	chars := func(n int) {
+		for i := 0; i < n*uartCharTicks; i++ {
+			u.tick()
+		}
+	}
+
+	if got := reg(uartLSR); got != lsrTHRE|lsrTEMT {
+		t.Fatalf("reset LSR: %#x", got)
+	}
+	if got := reg(uartIIR); got != iirNoInterrupt {
+		t.Fatalf("reset IIR: %#x", got)
+	}
+	if got := reg(uartMSR); got != msrCTS|msrDSR|msrDCD {
+		t.Fatalf("reset MSR: %#x", got)
+	}
+
+	// divisor latch
+	u.write(uartLCR, lcrDLAB|3, byt)
+	u.write(uartDLL, 0x12, byt)
+	u.write(uartDLM, 0x34, byt)
+	if reg(uartDLL) != 0x12 || reg(uartDLM) != 0x34 {
+		t.Fatal("divisor latch is not kept")
+	}
+	u.write(uartLCR, 3, byt)
+	if reg(uartIER) != 0 {
+		t.Fatal("IER is overwritten by DLM")
+	}
+
+	// FIFOs with the trigger level 4, in loopback mode
+	u.write(uartFCR, fcrEnable|fcrClearRx|fcrClearTx|1<<6, byt)
+	u.write(uartMCR, mcrLoopback, byt)
+	u.write(uartIER, ierRDA|ierTHRE|ierRLS, byt)
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirTHRE {
+		t.Fatalf("enabling THRE interrupt: IIR %#x", got)
+	}
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirNoInterrupt || irq {
+		t.Fatalf("THRE interrupt is not cleared by reading IIR: IIR %#x", got)
+	}
+
+	for _, b := range []byte("abc") {
+		u.write(uartTHR, uint64(b), byt)
+	}
+	if reg(uartLSR)&(lsrTHRE|lsrTEMT) != 0 {
+		t.Fatal("LSR reports empty transmitter")
+	}
+	chars(4)
+	if got := reg(uartLSR); got != lsrDR|lsrTHRE|lsrTEMT {
+		t.Fatalf("after sending: LSR %#x", got)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("loopback is sent to the host: %q", out.String())
+	}
+	// below the trigger level, only THRE is reported until the timeout.
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirTHRE {
+		t.Fatalf("below trigger level: IIR %#x", got)
+	}
+	chars(uartTimeoutChars)
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirTimeout || !irq {
+		t.Fatalf("timeout: IIR %#x", got)
+	}
+	for _, want := range []byte("abc") {
+		if got := reg(uartRBR); got != want {
+			t.Fatalf("rbr: want %q, got %q", want, got)
+		}
+	}
+	if reg(uartLSR)&lsrDR != 0 || irq {
+		t.Fatal("RX FIFO is not empty")
+	}
+
+	// reaching the trigger level, and overrun
+	for i := 0; i < uartFIFOSize+1; i++ {
+		u.write(uartTHR, uint64('A'+i), byt)
+		chars(2)
+		if i == 3 {
+			if got := reg(uartIIR); got != iirFIFOEnabled|iirRDA {
+				t.Fatalf("trigger level: IIR %#x", got)
+			}
+		}
+	}
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirRLS {
+		t.Fatalf("overrun: IIR %#x", got)
+	}
+	if got := reg(uartLSR); got&lsrOE == 0 {
+		t.Fatalf("overrun: LSR %#x", got)
+	}
+	if got := reg(uartLSR); got&lsrOE != 0 {
+		t.Fatal("OE is not cleared by reading LSR")
+	}
+	u.write(uartFCR, fcrEnable|fcrClearRx, byt)
+	if reg(uartLSR)&lsrDR != 0 {
+		t.Fatal("RX FIFO is not cleared")
+	}
+
+	// modem status follows MCR in loopback mode
+	u.write(uartIER, ierMS, byt)
+	u.write(uartMCR, mcrLoopback|mcrRTS|mcrOut1, byt)
+	if got := reg(uartIIR); got != iirFIFOEnabled|iirMS {
+		t.Fatalf("modem status: IIR %#x", got)
+	}
+	if got := reg(uartMSR); got != msrCTS|msrRI|msrDCTS|msrDDSR|msrDDCD {
+		t.Fatalf("loopback MSR: %#x", got)
+	}
+	u.write(uartMCR, mcrLoopback, byt)
+	if got := reg(uartMSR); got != msrDCTS|msrTERI {
+		t.Fatalf("loopback MSR: %#x", got)
+	}
+
+	// disabling FIFOs
+	u.write(uartFCR, 0, byt)
+	if got := reg(uartIIR); got&iirFIFOEnabled != 0 {
+		t.Fatalf("FIFOs are not disabled: IIR %#x", got)
+	}
+}
@@ -1,14 +1,443 @@
 package main
 
-type VirtIODisk struct{}
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
 
-func NewVirtIODisk() *VirtIODisk {
+// virtio-mmio (version 2) block device. It is located at 0x1000_1000.
+// https://docs.oasis-open.org/virtio/virtio/v1.1/virtio-v1.1.html
+const (
+	virtioBase = 0x1000_1000
+	virtioSize = 0x1000
+
+	// register offsets
+	virtioMagicValue        = 0x000
+	virtioVersion           = 0x004
+	virtioDeviceID          = 0x008
+	virtioVendorID          = 0x00c
+	virtioDeviceFeatures    = 0x010
+	virtioDeviceFeaturesSel = 0x014
+	virtioDriverFeatures    = 0x020
+	virtioDriverFeaturesSel = 0x024
+	virtioQueueSel          = 0x030
+	virtioQueueNumMax       = 0x034
+	virtioQueueNum          = 0x038
+	virtioQueueReady        = 0x044
+	virtioQueueNotify       = 0x050
+	virtioInterruptStatus   = 0x060
+	virtioInterruptACK      = 0x064
+	virtioStatus            = 0x070
+	virtioQueueDescLow      = 0x080
+	virtioQueueDescHigh     = 0x084
+	virtioQueueDriverLow    = 0x090
+	virtioQueueDriverHigh   = 0x094
+	virtioQueueDeviceLow    = 0x0a0
+	virtioQueueDeviceHigh   = 0x0a4
+	virtioConfigGeneration  = 0x0fc
+	virtioConfig            = 0x100
+
+	virtioMagic  = 0x74726976 // "virt"
+	virtioVendor = 0x554d4551 // "QEMU", xv6 checks this
+	virtioBlkID  = 2
+
+	virtioQueueSize = 1024
+
+	// features
+	virtioBlkFFlush = 1 << 9
+	virtioFVersion1 = 1 << 32
+
+	virtioFeatures uint64 = virtioFVersion1 | virtioBlkFFlush
+
+	// status
+	virtioStatusNeedsReset = 0x40
+
+	// descriptor flags
+	virtqDescFNext  = 1
+	virtqDescFWrite = 2
+
+	// request
+	virtioBlkTIn     = 0
+	virtioBlkTOut    = 1
+	virtioBlkTFlush  = 4
+	virtioBlkSOk     = 0
+	virtioBlkSIOErr  = 1
+	virtioBlkSUnsupp = 2
+
+	sectorSize = 512
+)
+
+type VirtIODisk struct {
+	image    *os.File
+	capacity uint64 // in sectors
+
+	deviceFeaturesSel uint32
+	driverFeatures    uint64
+	driverFeaturesSel uint32
+	status            uint32
+	interruptStatus   uint32
+
+	queueSel   uint32
+	queueNum   uint32
+	queueReady uint32
+	queueDesc  uint64
+	queueAvail uint64
+	queueUsed  uint64
+	lastAvail  uint16
+	notified   bool
+
+	ram *Memory
+	irq func(level bool)
+}
+
+func NewVirtIODisk(ram *Memory, irq func(level bool)) *VirtIODisk {
+	return &VirtIODisk{ram: ram, irq: irq}
+}
+
+// attach sets the disk image. Without image, the device ID is 0 which means no device is present.
+func (v *VirtIODisk) attach(image *os.File) error {
+	fi, err := image.Stat()
+	if err != nil {
+		return fmt.Errorf("stat disk image: %w", err)
+	}
+
+	v.image = image
+	v.capacity = uint64(fi.Size()) / sectorSize
 	return nil
 }
 
-func (v *VirtIODisk) read(addr uint64) uint8 {
+func (v *VirtIODisk) reset() {
+	*v = VirtIODisk{image: v.image, capacity: v.capacity, ram: v.ram, irq: v.irq}
+}
+
+func (v *VirtIODisk) interrupting() bool {
+	return v.interruptStatus != 0
+}
+
+// tick processes the requests in the queue when the driver notified.
+func (v *VirtIODisk) tick() {
+	v.processQueue()
+	v.irq(v.interrupting())
+}
+
+func (v *VirtIODisk) processQueue() {
+	if !v.notified {
+		return
+	}
+
+	ram := v.ram
+	v.notified = false
+	if v.queueReady == 0 || v.queueNum == 0 || v.status&virtioStatusNeedsReset != 0 {
+		return
+	}
+
+	n := uint64(v.queueNum)
+	if !ram.contains(v.queueDesc, 16*n) || !ram.contains(v.queueAvail, 4+2*n) || !ram.contains(v.queueUsed, 4+8*n) {
+		v.fail()
+		return
+	}
+
+	// avail ring: flags (16), idx (16), ring[queueNum] (16)
+	// used ring: flags (16), idx (16), ring[queueNum] {id (32), len (32)}
+	availIdx := uint16(ram.Read(v.queueAvail+2, halfword))
+	for v.lastAvail != availIdx {
+		head := uint16(ram.Read(v.queueAvail+4+uint64(v.lastAvail%uint16(v.queueNum))*2, halfword))
+		written, ok := v.process(ram, head)
+		if !ok {
+			v.fail()
+			return
+		}
+
+		usedIdx := uint16(ram.Read(v.queueUsed+2, halfword))
+		elem := v.queueUsed + 4 + uint64(usedIdx%uint16(v.queueNum))*8
+		ram.Write(elem, uint64(head), word)
+		ram.Write(elem+4, uint64(written), word)
+		ram.Write(v.queueUsed+2, uint64(usedIdx+1), halfword)
+
+		v.lastAvail++
+		v.interruptStatus |= 1 // used buffer notification
+	}
+}
+
+// fail tells the driver that the device cannot continue due to the driver's error.
+func (v *VirtIODisk) fail() {
+	v.status |= virtioStatusNeedsReset
+	v.interruptStatus |= 2 // configuration change notification
+}
+
+type virtqDesc struct {
+	addr  uint64
+	len   uint32
+	flags uint16
+	next  uint16
+}
+
+// process handles a request on the descriptor chain starting at head.
+// It returns the number of bytes written to the guest memory. ok is false if the chain is malformed.
+func (v *VirtIODisk) process(ram *Memory, head uint16) (written uint32, ok bool) {
+	// gather the chain. a request consists of device-readable descriptors
+	// (header and data to write) followed by device-writable descriptors (data to read and status).
+	var rd, wr []virtqDesc
+	idx := head
+	for n := uint32(0); ; n++ {
+		if uint32(idx) >= v.queueNum || n >= v.queueNum {
+			return 0, false
+		}
+
+		a := v.queueDesc + uint64(idx)*16
+		d := virtqDesc{
+			addr:  ram.Read(a, doubleword),
+			len:   uint32(ram.Read(a+8, word)),
+			flags: uint16(ram.Read(a+12, halfword)),
+			next:  uint16(ram.Read(a+14, halfword)),
+		}
+
+		if !ram.contains(d.addr, uint64(d.len)) {
+			return 0, false
+		}
+
+		if d.flags&virtqDescFWrite != 0 {
+			wr = append(wr, d)
+		} else if len(wr) != 0 {
+			return 0, false // readable descriptor after writable one
+		} else {
+			rd = append(rd, d)
+		}
+
+		if d.flags&virtqDescFNext == 0 {
+			break
+		}
+		idx = d.next
+	}
+
+	in := readChain(ram, rd)
+	if len(in) < 16 || len(wr) == 0 {
+		return 0, false
+	}
+
+	// the last writable byte is the status
+	last := &wr[len(wr)-1]
+	if last.len == 0 {
+		return 0, false
+	}
+	statusAddr := last.addr + uint64(last.len) - 1
+	last.len--
+
+	typ := binary.LittleEndian.Uint32(in[0:4])
+	sector := binary.LittleEndian.Uint64(in[8:16])
+	data := in[16:]
+
+	status := uint64(virtioBlkSOk)
+	switch typ {
+	case virtioBlkTIn:
+		buf := make([]byte, chainLen(wr))
+		if sector+uint64(len(buf))/sectorSize > v.capacity {
+			status = virtioBlkSIOErr
+			break
+		}
+		if _, err := v.image.ReadAt(buf, int64(sector*sectorSize)); err != nil {
+			status = virtioBlkSIOErr
+			break
+		}
+		writeChain(ram, wr, buf)
+		written = uint32(len(buf))
+
+	case virtioBlkTOut:
+		if sector+uint64(len(data))/sectorSize > v.capacity {
+			status = virtioBlkSIOErr
+			break
+		}
+		if _, err := v.image.WriteAt(data, int64(sector*sectorSize)); err != nil {
+			status = virtioBlkSIOErr
+		}
+
+	case virtioBlkTFlush:
+		if err := v.image.Sync(); err != nil {
+			status = virtioBlkSIOErr
+		}
+
+	default:
+		status = virtioBlkSUnsupp
+	}
+
+	ram.Write(statusAddr, status, byt)
+	return written + 1, true
+}
+
+func chainLen(descs []virtqDesc) int {
+	n := 0
+	for _, d := range descs {
+		n += int(d.len)
+	}
+	return n
+}
+
+func readChain(ram *Memory, descs []virtqDesc) []byte {
+	buf := make([]byte, 0, chainLen(descs))
+	for _, d := range descs {
+		for i := uint64(0); i < uint64(d.len); i++ {
+			buf = append(buf, uint8(ram.Read(d.addr+i, byt)))
+		}
+	}
+	return buf
+}
+
+func writeChain(ram *Memory, descs []virtqDesc, buf []byte) {
+	for _, d := range descs {
+		for i := uint64(0); i < uint64(d.len) && len(buf) != 0; i++ {
+			ram.Write(d.addr+i, uint64(buf[0]), byt)
+			buf = buf[1:]
+		}
+	}
+}
+
+func (v *VirtIODisk) read(offset uint64, size int) (uint64, bool) {
+	// config space can be accessed by any size
+	if offset >= virtioConfig {
+		if offset < virtioConfig+8 { // capacity
+			return readReg(v.capacity, offset-virtioConfig, size), true
+		}
+		return 0, true
+	}
+
+	// registers must be accessed by 32-bit
+	if size != word || offset%4 != 0 {
+		return 0, false
+	}
+
+	return uint64(v.load(offset)), true
+}
+
+func (v *VirtIODisk) write(offset, val uint64, size int) bool {
+	// config space is read-only
+	if offset >= virtioConfig {
+		return true
+	}
+
+	// registers must be accessed by 32-bit
+	if size != word || offset%4 != 0 {
+		return false
+	}
+
+	v.store(offset, uint32(val))
+	return true
+}
+
+// queueReg returns true if the register is of the queue selected by QueueSel.
+func queueReg(off uint64) bool {
+	switch off {
+	case virtioQueueNumMax, virtioQueueNum, virtioQueueReady,
+		virtioQueueDescLow, virtioQueueDescHigh, virtioQueueDriverLow, virtioQueueDriverHigh,
+		virtioQueueDeviceLow, virtioQueueDeviceHigh:
+		return true
+	}
+
+	return false
+}
+
+func (v *VirtIODisk) load(off uint64) uint32 {
+	// only queue 0 exists. The registers of the other queues read as zero,
+	// and QueueNumMax = 0 tells the driver that the queue is not available.
+	if v.queueSel != 0 && queueReg(off) {
+		return 0
+	}
+
+	switch off {
+	case virtioMagicValue:
+		return virtioMagic
+	case virtioVersion:
+		return 2
+	case virtioDeviceID:
+		if v.image == nil {
+			return 0
+		}
+		return virtioBlkID
+	case virtioVendorID:
+		return virtioVendor
+	case virtioDeviceFeatures:
+		return uint32(virtioFeatures >> (32 * (v.deviceFeaturesSel & 1)))
+	case virtioDeviceFeaturesSel:
+		return v.deviceFeaturesSel
+	case virtioDriverFeatures:
+		return uint32(v.driverFeatures >> (32 * (v.driverFeaturesSel & 1)))
+	case virtioDriverFeaturesSel:
+		return v.driverFeaturesSel
+	case virtioQueueNumMax:
+		return virtioQueueSize
+	case virtioQueueNum:
+		return v.queueNum
+	case virtioQueueReady:
+		return v.queueReady
+	case virtioInterruptStatus:
+		return v.interruptStatus
+	case virtioStatus:
+		return v.status
+	case virtioQueueDescLow:
+		return uint32(v.queueDesc)
+	case virtioQueueDescHigh:
+		return uint32(v.queueDesc >> 32)
+	case virtioQueueDriverLow:
+		return uint32(v.queueAvail)
+	case virtioQueueDriverHigh:
+		return uint32(v.queueAvail >> 32)
+	case virtioQueueDeviceLow:
+		return uint32(v.queueUsed)
+	case virtioQueueDeviceHigh:
+		return uint32(v.queueUsed >> 32)
+	case virtioConfigGeneration:
+		return 0
+	}
+
 	return 0
 }
 
-func (v *VirtIODisk) write(addr uint64, value uint8) {
+func (v *VirtIODisk) store(off uint64, value uint32) {
+	// writes to the registers of the queues which don't exist are ignored.
+	if v.queueSel != 0 && queueReg(off) {
+		return
+	}
+
+	switch off {
+	case virtioDeviceFeaturesSel:
+		v.deviceFeaturesSel = value
+	case virtioDriverFeatures:
+		shift := 32 * (v.driverFeaturesSel & 1)
+		v.driverFeatures = v.driverFeatures&^(0xffffffff<<shift) | uint64(value)<<shift
+	case virtioDriverFeaturesSel:
+		v.driverFeaturesSel = value
+	case virtioQueueSel:
+		v.queueSel = value
+	case virtioQueueNum:
+		if value <= virtioQueueSize {
+			v.queueNum = value
+		}
+	case virtioQueueReady:
+		v.queueReady = value & 1
+	case virtioQueueNotify:
+		// the value is the index of the notified queue.
+		if value == 0 {
+			v.notified = true
+		}
+	case virtioInterruptACK:
+		v.interruptStatus &^= value
+	case virtioStatus:
+		if value == 0 {
+			v.reset()
+			return
+		}
+		v.status = value
+	case virtioQueueDescLow:
+		v.queueDesc = v.queueDesc&^0xffffffff | uint64(value)
+	case virtioQueueDescHigh:
+		v.queueDesc = v.queueDesc&0xffffffff | uint64(value)<<32
+	case virtioQueueDriverLow:
+		v.queueAvail = v.queueAvail&^0xffffffff | uint64(value)
+	case virtioQueueDriverHigh:
+		v.queueAvail = v.queueAvail&0xffffffff | uint64(value)<<32
+	case virtioQueueDeviceLow:
+		v.queueUsed = v.queueUsed&^0xffffffff | uint64(value)
+	case virtioQueueDeviceHigh:
+		v.queueUsed = v.queueUsed&0xffffffff | uint64(value)<<32
+	}
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVirtIODisk(t *testing.T) {
+	image := make([]byte, 2*sectorSize)
+	for i := range image {
+		image[i] = uint8(i / sectorSize)
+	}
+
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cpu := NewCPU(defaultRAMSize)
+	if err := cpu.disk.attach(f); err != nil {
+		t.Fatal(err)
+	}
+
+	w := func(off, val uint64) { cpu.writeRaw(virtioBase+off, val, word) }
+	r := func(off uint64) uint64 { v, _ := cpu.readRaw(virtioBase+off, word); return v }
+
+	if r(virtioMagicValue) != virtioMagic || r(virtioVersion) != 2 || r(virtioDeviceID) != virtioBlkID {
+		t.Fatalf("unexpected device identification")
+	}
+	if r(virtioConfig) != 2 {
+		t.Fatalf("capacity: want 2, got %d", r(virtioConfig))
+	}
+
+	const (
+		desc   = drambase + 0x1000
+		avail  = drambase + 0x2000
+		used   = drambase + 0x3000
+		header = drambase + 0x4000
+		data   = drambase + 0x5000
+		status = drambase + 0x6000
+	)
+
+	w(virtioStatus, 0xb) // ACKNOWLEDGE | DRIVER | FEATURES_OK
+	w(virtioQueueSel, 0)
+	w(virtioQueueNum, 8)
+	w(virtioQueueDescLow, desc)
+	w(virtioQueueDriverLow, avail)
+	w(virtioQueueDeviceLow, used)
+	w(virtioQueueReady, 1)
+	w(virtioStatus, 0xf) // DRIVER_OK
+
+	putDesc := func(i, addr, len, flags, next uint64) {
+		a := desc + i*16
+		cpu.ram.Write(a, addr, doubleword)
+		cpu.ram.Write(a+8, len, word)
+		cpu.ram.Write(a+12, flags, halfword)
+		cpu.ram.Write(a+14, next, halfword)
+	}
+
+	request := func(typ, sector, dataFlags uint64) {
+		cpu.ram.Write(header, typ, word)
+		cpu.ram.Write(header+8, sector, doubleword)
+		putDesc(0, header, 16, virtqDescFNext, 1)
+		putDesc(1, data, sectorSize, dataFlags|virtqDescFNext, 2)
+		putDesc(2, status, 1, virtqDescFWrite, 0)
+
+		idx := cpu.ram.Read(avail+2, halfword)
+		cpu.ram.Write(avail+4+(idx%8)*2, 0, halfword)
+		cpu.ram.Write(avail+2, idx+1, halfword)
+		cpu.ram.Write(status, 0xff, byt)
+
+		w(virtioQueueNotify, 0)
+		cpu.disk.tick()
+
+		if got := cpu.ram.Read(status, byt); got != virtioBlkSOk {
+			t.Fatalf("status: want ok, got %d", got)
+		}
+		if got := cpu.ram.Read(used+2, halfword); got != idx+1 {
+			t.Fatalf("used idx: want %d, got %d", idx+1, got)
+		}
+		if !cpu.disk.interrupting() {
+			t.Fatalf("interrupt is not raised")
+		}
+		w(virtioInterruptACK, r(virtioInterruptStatus))
+		if cpu.disk.interrupting() {
+			t.Fatalf("interrupt is not acknowledged")
+		}
+	}
+
+	// read sector 1
+	request(virtioBlkTIn, 1, virtqDescFWrite)
+	for i := uint64(0); i < sectorSize; i++ {
+		if got := cpu.ram.Read(data+i, byt); got != 1 {
+			t.Fatalf("read data[%d]: want 1, got %d", i, got)
+		}
+	}
+	if got := cpu.ram.Read(used+4+4, word); got != sectorSize+1 {
+		t.Fatalf("used len: want %d, got %d", sectorSize+1, got)
+	}
+
+	// write sector 0
+	for i := uint64(0); i < sectorSize; i++ {
+		cpu.ram.Write(data+i, 0xaa, byt)
+	}
+	request(virtioBlkTOut, 0, 0)
+	request(virtioBlkTFlush, 0, 0)
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:sectorSize], bytes.Repeat([]byte{0xaa}, sectorSize)) {
+		t.Fatalf("sector 0 is not written")
+	}
+}
+
+func TestVirtIOQueueSel(t *testing.T) {
+	v := NewVirtIODisk(NewMemory(0x10000), func(bool) {})
+	w := func(off uint64, val uint32) { v.store(off, val) }
+
+	w(virtioQueueSel, 0)
+	w(virtioQueueNum, 8)
+	w(virtioQueueDescLow, 0x1000)
+	w(virtioQueueDriverLow, 0x2000)
+	w(virtioQueueDeviceLow, 0x3000)
+	w(virtioQueueReady, 1)
+
+	// queue 1 doesn't exist, so its registers read as zero and writes are ignored.
+	w(virtioQueueSel, 1)
+	for _, off := range []uint64{virtioQueueNumMax, virtioQueueNum, virtioQueueReady, virtioQueueDescLow, virtioQueueDriverLow, virtioQueueDeviceLow} {
+		if got := v.load(off); got != 0 {
+			t.Errorf("queue 1 register %#x: want 0, got %d", off, got)
+		}
+	}
+	w(virtioQueueNum, 16)
+	w(virtioQueueDescLow, 0xdead)
+	w(virtioQueueDescHigh, 0xdead)
+	w(virtioQueueDriverLow, 0xdead)
+	w(virtioQueueDeviceLow, 0xdead)
+	w(virtioQueueReady, 0)
+	w(virtioQueueNotify, 1)
+	if v.notified {
+		t.Errorf("notifying queue 1 notifies queue 0")
+	}
+
+	w(virtioQueueSel, 0)
+	if got := v.load(virtioQueueNumMax); got != virtioQueueSize {
+		t.Errorf("queue 0 QueueNumMax: want %d, got %d", virtioQueueSize, got)
+	}
+	if v.queueNum != 8 || v.queueDesc != 0x1000 || v.queueAvail != 0x2000 || v.queueUsed != 0x3000 || v.queueReady != 1 {
+		t.Errorf("queue 0 is changed by queue 1: num %d, desc %#x, driver %#x, device %#x, ready %d", v.queueNum, v.queueDesc, v.queueAvail, v.queueUsed, v.queueReady)
+	}
+}